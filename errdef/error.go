@@ -36,8 +36,25 @@ var (
 	NoRunningPod           = ErrorInfo{http.StatusInternalServerError, "NoRunningPod", "No running pod available."}
 	ControlClusterNotFound = ErrorInfo{http.StatusInternalServerError, "ControlClusterNotFound", "Control cluster not found."}
 	InvalidToken           = &ErrorInfo{http.StatusUnauthorized, "InvalidToken", "Token invalid."}
+	RecordingNotFound      = ErrorInfo{http.StatusNotFound, "RecordingNotFound", "Recording not found."}
+	SessionNotFound        = ErrorInfo{http.StatusNotFound, "SessionNotFound", "Session not found."}
+	InvalidParameter       = ErrorInfo{http.StatusBadRequest, "InvalidParameter", "Invalid parameter."}
+	DebugNotAllowed        = ErrorInfo{http.StatusForbidden, "DebugNotAllowed", "Debug container is not allowed in the namespace."}
+	NodeShellNotAllowed    = ErrorInfo{http.StatusForbidden, "NodeShellNotAllowed", "Node shell is not enabled."}
+	PortForwardNotAllowed  = ErrorInfo{http.StatusForbidden, "PortForwardNotAllowed", "Port is not allowed to forward."}
+	ServerShuttingDown     = ErrorInfo{http.StatusServiceUnavailable, "ServerShuttingDown", "Server is shutting down, please retry."}
 )
 
+// SessionQuotaExceeded is returned when the session quota per user, cluster, namespace or replica is used up
+func SessionQuotaExceeded(quota string, used, limit int) ErrorInfo {
+	return ErrorInfo{http.StatusTooManyRequests, "SessionQuotaExceeded", fmt.Sprintf("Session quota per %s exceeded, %d of %d sessions in use.", quota, used, limit)}
+}
+
+// FileTransferFailed is returned when tar in the container fails to download or upload files
+func FileTransferFailed(err error, stderr string) ErrorInfo {
+	return ErrorInfo{http.StatusInternalServerError, "FileTransferFailed", fmt.Sprintf("File transfer failed: %v: %s", err, stderr)}
+}
+
 func (ei ErrorInfo) WithMarshal() []byte {
 	res, err := json.Marshal(ei)
 	if err != nil {
@@ -27,6 +27,10 @@ import (
 
 // HandleInternalError writes the given error to the response and sets appropriate HTTP status headers.
 func HandleInternalError(response *restful.Response, err error) {
+	if errInfo, ok := err.(ErrorInfo); ok {
+		HandleInternalErrorByCode(response, errInfo)
+		return
+	}
 	clog.Error("%v", err)
 	statusCode := http.StatusInternalServerError
 	statusError, ok := err.(*errors.StatusError)
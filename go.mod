@@ -6,10 +6,13 @@ require (
 	github.com/astaxie/beego v1.12.3
 	github.com/emicklei/go-restful v2.16.0+incompatible
 	github.com/golang-jwt/jwt v3.2.1+incompatible
+	github.com/gorilla/websocket v1.4.2
 	github.com/kubecube-io/kubecube v1.2.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/prometheus/client_golang v1.11.0
 	github.com/shiena/ansicolor v0.0.0-20200904210342-c7312218db18 // indirect
 	gopkg.in/igm/sockjs-go.v2 v2.1.0
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	k8s.io/api v0.23.2
 	k8s.io/apimachinery v0.23.2
 	k8s.io/client-go v0.23.2
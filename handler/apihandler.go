@@ -17,7 +17,6 @@ limitations under the License.
 package handler
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/emicklei/go-restful"
@@ -36,10 +35,18 @@ import (
 
 const PlatformKubeCube = "kubecube"
 
-func init() {
+// Init must be called after flags parsed
+func Init() {
 	clog.Info("webconsole initializing")
 
 	initConfig()
+	initSession()
+	initShell()
+	initRecord()
+	initDebug()
+	initPortForward()
+	initCommandPolicy()
+	initRedact()
 	initAudit()
 
 	clog.Info("webconsole initialized")
@@ -62,13 +69,57 @@ func CreateHTTPAPIHandler() http.Handler {
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON)
 
+	recordWs := new(restful.WebService)
+
+	recordWs.Path("/api/v1/recordings").
+		Produces(castContentType, restful.MIME_JSON)
+
+	adminWs := new(restful.WebService)
+	adminWs.Filter(AdminAuthorityVerify)
+
+	adminWs.Path("/api/v1/admin").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	// more specific than apiV1Ws so node routes are not verified by PodAuthorityVerify
+	nodeWs := new(restful.WebService)
+	nodeWs.Filter(NodeAuthorityVerify)
+
+	nodeWs.Path("/api/v1/{cluster}/node").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
 	wsContainer.Add(apiV1Ws)
 	wsContainer.Add(apiV2Ws)
+	wsContainer.Add(recordWs)
+	wsContainer.Add(adminWs)
+	wsContainer.Add(nodeWs)
 
 	apiV1Ws.Route(
 		apiV1Ws.GET("{cluster}/namespace/{namespace}/pod/{pod}/shell/{container}").
 			To(handleExecShell).
 			Writes(TerminalResponse{}))
+	apiV1Ws.Route(
+		apiV1Ws.GET("{cluster}/namespace/{namespace}/pod/{pod}/log/{container}").
+			To(handleLogShell).
+			Writes(TerminalResponse{}))
+	apiV1Ws.Route(
+		apiV1Ws.GET("{cluster}/namespace/{namespace}/pod/{pod}/watch/{session}").
+			To(handleWatchShell).
+			Writes(TerminalResponse{}))
+	apiV1Ws.Route(
+		apiV1Ws.GET("{cluster}/namespace/{namespace}/pod/{pod}/file/{container}").
+			To(handleDownloadFile).
+			Produces(tarContentType, restful.MIME_JSON))
+	apiV1Ws.Route(
+		apiV1Ws.PUT("{cluster}/namespace/{namespace}/pod/{pod}/file/{container}").
+			To(handleUploadFile).
+			Consumes(tarContentType, "application/octet-stream").
+			Writes(TerminalResponse{}))
+	apiV1Ws.Route(
+		apiV1Ws.GET("{cluster}/namespace/{namespace}/pod/{pod}/portforward/{port}").
+			To(handlePortForward).
+			Writes(TerminalResponse{}))
 	//apiV1Ws.Route(
 	//	apiV1Ws.GET("{cluster}/pod/{namespace}/{pod}/shell/{container}").
 	//		To(handleExecShell).
@@ -77,6 +128,29 @@ func CreateHTTPAPIHandler() http.Handler {
 		apiV2Ws.GET("cloudShell/clusters/{cluster}").
 			To(handleCloudShellExec).
 			Writes(TerminalResponse{}))
+	nodeWs.Route(
+		nodeWs.GET("{node}/shell").
+			To(handleNodeShell).
+			Writes(TerminalResponse{}))
+	recordWs.Route(
+		recordWs.GET("{session}").
+			To(handleGetRecording))
+	adminWs.Route(
+		adminWs.GET("sessions").
+			To(handleListSessions).
+			Writes([]LiveSession{}))
+	adminWs.Route(
+		adminWs.GET("sessions/{session}").
+			To(handleGetSession).
+			Writes(LiveSession{}))
+	adminWs.Route(
+		adminWs.DELETE("sessions/{session}").
+			To(handleTerminateSession).
+			Writes(LiveSession{}))
+	adminWs.Route(
+		adminWs.GET("audit").
+			To(handleAuditStatus).
+			Writes([]AuditQueueStatus{}))
 
 	return wsContainer
 
@@ -84,24 +158,18 @@ func CreateHTTPAPIHandler() http.Handler {
 
 // CreateAttachHandler is called from main for /api/sockjs
 func CreateAttachHandler(path string) http.Handler {
-	return sockjs.NewHandler(path, sockjs.DefaultOptions, handleTerminalSession)
+	return sockjs.NewHandler(path, sockjs.DefaultOptions, func(session sockjs.Session) {
+		// SockJS does not expose the request, the token comes with the bind message
+		handleTerminalSession(session, nil)
+	})
 }
 
 // Handles execute shell API call
 func handleExecShell(request *restful.Request, response *restful.Response) {
-
-	sessionId, err := utils.GenTerminalSessionId()
-	if err != nil {
-		clog.Error("generate session id failed. Error msg: " + err.Error())
-		errdef.HandleInternalError(response, err)
-		return
-	}
-	clog.Info("sessionId: %s", sessionId)
-
 	clusterName := request.PathParameter("cluster")
 
 	// get restClient from map base on clusterName
-	_, err = getNonControlCfg(clusterName)
+	_, err := getNonControlCfg(clusterName)
 	if err != nil {
 		clog.Error("fail to fetch rest.config for cluster [%s], msg: %v", clusterName, err)
 		errdef.HandleInternalErrorByCode(response, errdef.ClusterInfoNotFound)
@@ -113,15 +181,36 @@ func handleExecShell(request *restful.Request, response *restful.Response) {
 		errdef.HandleInternalErrorByCode(response, *errInfo)
 		return
 	}
-	cacheConnInfo(sessionId, cInfo)
+	cInfo.Owner = utils.GetUserFromReq(request)
+
+	// mode=attach attaches to the main process instead of running a shell,
+	// mode=debug injects an ephemeral container and attaches to it
+	switch mode := request.QueryParameter("mode"); mode {
+	case "", "exec":
+		cInfo.Kind = SessionKindExec
+	case SessionKindAttach:
+		cInfo.Kind = SessionKindAttach
+	case SessionKindDebug:
+		if !isDebugAllowed(cInfo.ClusterName, cInfo.Namespace) {
+			errdef.HandleInternalErrorByCode(response, errdef.DebugNotAllowed)
+			return
+		}
+		cInfo.Kind = SessionKindDebug
+	default:
+		clog.Warn("unknown session mode %v", mode)
+		errdef.HandleInternalErrorByCode(response, errdef.InvalidParameter)
+		return
+	}
 
-	_ = response.WriteHeaderAndEntity(http.StatusOK, TerminalResponse{Id: sessionId})
-}
+	sessionId, err := issueSession(cInfo)
+	if err != nil {
+		clog.Error("generate session id failed. Error msg: " + err.Error())
+		errdef.HandleInternalError(response, err)
+		return
+	}
+	clog.Info("sessionId: %s", sessionId)
 
-func cacheConnInfo(sessionId string, info *ConnInfo) {
-	v, _ := json.Marshal(info)
-	// save container-connect info to sync.Map
-	connMap.Store(sessionId, string(v))
+	_ = response.WriteHeaderAndEntity(http.StatusOK, TerminalResponse{Id: sessionId})
 }
 
 func getConnInfo(request *restful.Request) (*ConnInfo, *errdef.ErrorInfo) {
@@ -134,7 +223,20 @@ func getConnInfo(request *restful.Request) (*ConnInfo, *errdef.ErrorInfo) {
 	scriptUID := request.QueryParameter("uid")
 	scriptUserAuth := request.QueryParameter("auth")
 
-	// Audit related info
+	return &ConnInfo{
+		Namespace:      namespace,
+		PodName:        podName,
+		ContainerName:  containerName,
+		ClusterName:    clusterName,
+		ScriptUID:      scriptUID,
+		ScriptUser:     scriptUser,
+		ScriptUserAuth: scriptUserAuth,
+		AuditRawInfo:   getAuditRawInfo(request),
+	}, nil
+}
+
+// getAuditRawInfo returns who requests the session and from where
+func getAuditRawInfo(request *restful.Request) *AuditRawInfo {
 	webUser := request.QueryParameter("webuser")
 	platform := request.QueryParameter("platform")
 	// 未传入platform信息时，认为是KubeCube页面传入的
@@ -152,21 +254,12 @@ func getConnInfo(request *restful.Request) (*ConnInfo, *errdef.ErrorInfo) {
 		ua = request.HeaderParameter("User-Agent")
 	}
 
-	return &ConnInfo{
-		Namespace:      namespace,
-		PodName:        podName,
-		ContainerName:  containerName,
-		ClusterName:    clusterName,
-		ScriptUID:      scriptUID,
-		ScriptUser:     scriptUser,
-		ScriptUserAuth: scriptUserAuth,
-		AuditRawInfo: &AuditRawInfo{
-			RemoteIP:  remoteIP,
-			UserAgent: ua,
-			WebUser:   webUser,
-			Platform:  platform,
-		},
-	}, nil
+	return &AuditRawInfo{
+		RemoteIP:  remoteIP,
+		UserAgent: ua,
+		WebUser:   webUser,
+		Platform:  platform,
+	}
 }
 
 // init rest.Config base on kubeconfig
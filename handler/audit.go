@@ -18,6 +18,8 @@ package handler
 
 import (
 	"context"
+	"fmt"
+	"github.com/emicklei/go-restful"
 	"io/ioutil"
 	"k8s.io/klog/v2"
 	"net/http"
@@ -26,15 +28,18 @@ import (
 )
 
 const (
-	MaxRetry       = 5
+	MaxRetry       = 5 // retries of the memory audit queue, the spool retries until success
 	MaxIdlePerHost = 100
 	RequestTimeout = 3 // second
 )
 
-var AuditAdapter *auditAdapter
+// auditSinks publishes audit messages to all configured sinks
+var auditSinks *auditFanout
 
+// auditAdapter is the AuditSink sending messages to the audit service by http
 type auditAdapter struct {
 	URL        string
+	BatchURL   string // receives a JSON array of messages, messages are sent one by one if it is empty
 	Method     string
 	Header     string
 	HttpClient *http.Client
@@ -46,33 +51,60 @@ type Response struct {
 	ErrorCode string `json:"errorCode"`
 }
 
-func (adapter *auditAdapter) Publish(payload string, id string) {
+func newHTTPAuditSink() AuditSink {
+	// 初始化http client
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: MaxIdlePerHost,
+		},
+		Timeout: RequestTimeout * time.Second,
+	}
+	return &auditAdapter{
+		URL:        *auditURL,
+		BatchURL:   *auditBatchURL,
+		Method:     *auditMethod,
+		Header:     *auditHeader,
+		HttpClient: httpClient,
+	}
+}
 
+func (adapter *auditAdapter) Name() string {
+	return AuditSinkHTTP
+}
+
+// Publish sends payload once, retries are done by the audit queue of the sink
+func (adapter *auditAdapter) Publish(payload string, id string) error {
 	klog.Infof("[%v] audit message: %s", id, payload)
+	return adapter.send(adapter.URL, payload, id)
+}
 
-	// The initial wait interval, hard-coded to 80ms
-	interval := 80 * time.Millisecond
-	for i := 0; i < MaxRetry; i++ {
-		if i != 0 {
-			klog.Warningf("[%v] send audit message failed, retry after %v", id, interval)
-			time.Sleep(interval)
-			interval = time.Duration(int64(float32(interval) * 2.5))
-		}
-		err := adapter.sendWithRetry(payload, id)
-		if err != nil {
-			klog.Errorf("[%v] unexpected error when request audit svc, error: %v", id, err)
-			continue
+// PublishBatch sends records in one request to BatchURL
+func (adapter *auditAdapter) PublishBatch(records []auditRecord) (int, error) {
+	if adapter.BatchURL == "" {
+		for i, r := range records {
+			if err := adapter.Publish(r.Payload, r.ID); err != nil {
+				return i, err
+			}
 		}
-		klog.Infof("[%v] send audit message to audit svc success.", id)
-		return
+		return len(records), nil
 	}
 
+	payloads := make([]string, 0, len(records))
+	for _, r := range records {
+		payloads = append(payloads, r.Payload)
+	}
+	id := records[0].ID
+	klog.Infof("[%v] audit batch of %d messages", id, len(records))
+	if err := adapter.send(adapter.BatchURL, "["+strings.Join(payloads, ",")+"]", id); err != nil {
+		return 0, err
+	}
+	return len(records), nil
 }
 
-func (adapter *auditAdapter) sendWithRetry(payload string, id string) error {
-	request, err := http.NewRequest(adapter.Method, adapter.URL, strings.NewReader(payload))
+func (adapter *auditAdapter) send(url string, payload string, id string) error {
+	request, err := http.NewRequest(adapter.Method, url, strings.NewReader(payload))
 	if err != nil {
-		klog.Error("[%v] create http request error: %v", id, err)
+		klog.Errorf("[%v] create http request error: %v", id, err)
 		return err
 	}
 	headers := strings.Split(adapter.Header, ";")
@@ -97,17 +129,18 @@ func (adapter *auditAdapter) sendWithRetry(payload string, id string) error {
 		return err
 	}
 
-	klog.Warningf("[%v] response from audit service, statusCode=%d, body=%s", id, resp.StatusCode, content)
-
-	//result := &Response{}
-	//err = json.Unmarshal(content, result)
-	//if err != nil {
-	//	klog.Errorf("[%v] unmarshal response json error: %s", id, err.Error())
-	//	return err
-	//}
-	//
-	//if resp.StatusCode != http.StatusOK || result.Code != http.StatusOK {
-	//	return errors.New("bad response status code")
-	//}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("bad response status code %d from audit service, body: %s", resp.StatusCode, content)
+	}
+	klog.Infof("[%v] send audit message to audit svc success.", id)
 	return nil
 }
+
+// handleAuditStatus returns the backlog of every audit sink
+func handleAuditStatus(request *restful.Request, response *restful.Response) {
+	status := []AuditQueueStatus{}
+	if auditSinks != nil {
+		status = auditSinks.Status()
+	}
+	_ = response.WriteHeaderAndEntity(http.StatusOK, status)
+}
@@ -30,6 +30,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"kubecube-webconsole/errdef"
 	"kubecube-webconsole/utils"
 	"net/http"
 	"strings"
@@ -69,6 +70,36 @@ func PodAuthorityVerify(request *restful.Request, response *restful.Response, ch
 	}
 }
 
+// AdminAuthorityVerify only allows platform admins, the users who can delete pods in all namespaces
+// of the pivot cluster. KubeCube grants tenant and project roles by namespace, so only platform-admin
+// has the cluster-wide permission.
+func AdminAuthorityVerify(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	user := utils.GetUserFromReq(request)
+	if user == "" {
+		clog.Error("the user is not exists")
+		_ = response.WriteHeaderAndEntity(http.StatusUnauthorized, TerminalResponse{Message: "permission denied"})
+		return
+	}
+	pivot, err := GetPivotCluster()
+	if err != nil {
+		clog.Error("get pivot cluster failed: %v", err)
+		errdef.HandleInternalErrorByCode(response, errdef.ControlClusterNotFound)
+		return
+	}
+	if !isAccessAllowed(&attributes{
+		User:            user,
+		Verb:            "delete",
+		Resource:        "pods",
+		ResourceRequest: true,
+		Cluster:         pivot.Name,
+	}) {
+		clog.Info("user %v is not admin", user)
+		_ = response.WriteHeaderAndEntity(http.StatusForbidden, TerminalResponse{Message: "permission denied"})
+		return
+	}
+	chain.ProcessFilter(request, response)
+}
+
 // determine whether the user has permission to operate the pod under the namespace
 func isAuthValid(request *restful.Request) bool {
 	user := utils.GetUserFromReq(request)
@@ -86,6 +117,11 @@ func isAuthValid(request *restful.Request) bool {
 		ResourceRequest: true,
 		Cluster:         cluster,
 	}
+	return isAccessAllowed(attribute)
+}
+
+// isAccessAllowed asks KubeCube whether the attributes are allowed
+func isAccessAllowed(attribute *attributes) bool {
 	bytesData, err := json.Marshal(attribute)
 	if err != nil {
 		clog.Error("marshal json error: %s", err)
@@ -18,7 +18,6 @@ package handler
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/kubecube-io/kubecube/pkg/utils/constants"
@@ -107,20 +106,17 @@ func handleCloudShellExec(request *restful.Request, response *restful.Response)
 		ClusterName:      ctrlCluster.GetName(),
 		IsControlCluster: true,
 		Header:           request.Request.Header,
+		Owner:            utils.GetUserFromReq(request),
+		AuditRawInfo:     getAuditRawInfo(request),
 	}
 
-	connInfoBytes, _ := json.Marshal(shellConnInfo)
-
-	sessionId, err := utils.GenTerminalSessionId()
+	sessionId, err := issueSession(&shellConnInfo)
 	if err != nil {
 		clog.Error("Generate session id failed. Error msg: " + err.Error())
 		errdef.HandleInternalError(response, err)
 		return
 	}
 	clog.Info("SessionId: %s", sessionId)
-
-	// save container-connect info to memory
-	connMap.Store(sessionId, string(connInfoBytes))
 	_ = response.WriteHeaderAndEntity(http.StatusOK, TerminalResponse{Id: sessionId})
 }
 
@@ -0,0 +1,116 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+)
+
+const debugContainerPrefix = "debugger-"
+
+// isDebugAllowed returns true if debug containers can be injected to pods of the namespace
+func isDebugAllowed(cluster, namespace string) bool {
+	return *enableDebug && debugScopeList.Match(cluster, namespace)
+}
+
+// debugContainer injects an ephemeral container sharing the process namespace of
+// the target container, as `kubectl debug -it --target` does, then attaches to it.
+// This is used for images without any shell, such as distroless.
+func debugContainer(k8sClient *rest.RESTClient, cfg *rest.Config, info *ConnInfo, t TerminalSession) error {
+	name := debugContainerPrefix + utilrand.String(5)
+	ec := v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{
+			Name:                     name,
+			Image:                    *debugImage,
+			ImagePullPolicy:          v1.PullIfNotPresent,
+			Stdin:                    true,
+			TTY:                      true,
+			TerminationMessagePolicy: v1.TerminationMessageReadFile,
+		},
+		TargetContainerName: info.ContainerName,
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"ephemeralContainers": []v1.EphemeralContainer{ec},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	err = k8sClient.Patch(types.StrategicMergePatchType).
+		Resource("pods").
+		Name(info.PodName).
+		Namespace(info.Namespace).
+		SubResource("ephemeralcontainers").
+		Body(patch).
+		Do(ctx).
+		Error()
+	if err != nil {
+		clog.Error("inject debug container to pod %v failed: %v", info.PodName, err)
+		return err
+	}
+
+	clog.Info("debug container %v with image %v is injected to pod %v/%v targeting %v", name, *debugImage, info.Namespace, info.PodName, info.ContainerName)
+	t.audit(fmt.Sprintf("inject debug container %s with image %s targeting container %s", name, *debugImage, info.ContainerName), "debug")
+	_ = t.Toast(fmt.Sprintf("Waiting for debug container %s with image %s to start...", name, *debugImage))
+
+	if err = waitForEphemeralContainer(ctx, k8sClient, info, name); err != nil {
+		clog.Error("wait for debug container %v of pod %v failed: %v", name, info.PodName, err)
+		return err
+	}
+
+	debugInfo := *info
+	debugInfo.ContainerName = name
+	return attachToContainer(k8sClient, cfg, &debugInfo, t)
+}
+
+func waitForEphemeralContainer(ctx context.Context, k8sClient *rest.RESTClient, info *ConnInfo, name string) error {
+	return wait.PollImmediate(time.Second, *debugStartTimeout, func() (bool, error) {
+		pod := v1.Pod{}
+		err := k8sClient.Get().
+			Resource("pods").
+			Name(info.PodName).
+			Namespace(info.Namespace).
+			Do(ctx).
+			Into(&pod)
+		if err != nil {
+			return false, err
+		}
+		for _, status := range pod.Status.EphemeralContainerStatuses {
+			if status.Name != name {
+				continue
+			}
+			if status.State.Terminated != nil {
+				return false, fmt.Errorf("debug container %s terminated: %s", name, status.State.Terminated.Reason)
+			}
+			return status.State.Running != nil, nil
+		}
+		return false, nil
+	})
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	"kubecube-webconsole/errdef"
+	"kubecube-webconsole/utils"
+)
+
+const (
+	tarContentType = "application/x-tar"
+	// stderr of tar is only used in error message
+	maxStderrBytes = 4096
+)
+
+// countingWriter counts bytes written to w, start is called before the first byte is written
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	start func()
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.start != nil && len(p) > 0 {
+		c.start()
+		c.start = nil
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader counts bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitedBuffer drops bytes over its limit
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.limit - l.Len(); room > 0 {
+		if len(p) > room {
+			l.Buffer.Write(p[:room])
+		} else {
+			l.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// getTransferInfo returns container-connect info and the cleaned absolute path in container
+func getTransferInfo(request *restful.Request) (*ConnInfo, string, *errdef.ErrorInfo) {
+	filePath := request.QueryParameter("path")
+	if filePath == "" || !path.IsAbs(filePath) {
+		return nil, "", &errdef.InvalidParameter
+	}
+	filePath = path.Clean(filePath)
+
+	cInfo, errInfo := getConnInfo(request)
+	if errInfo != nil {
+		return nil, "", errInfo
+	}
+	cInfo.Owner = utils.GetUserFromReq(request)
+	return cInfo, filePath, nil
+}
+
+// acquireTransfer takes the session quota for a transfer as it holds an exec stream like sessions do,
+// and rejects it while the server is draining. The quota must be released once the transfer ends.
+func acquireTransfer(info *ConnInfo) *errdef.ErrorInfo {
+	if IsDraining() {
+		return &errdef.ServerShuttingDown
+	}
+	return sessionQuotas.Acquire(info)
+}
+
+// handleDownloadFile streams a tar archive of the file or directory in container to the client
+func handleDownloadFile(request *restful.Request, response *restful.Response) {
+	cInfo, filePath, errInfo := getTransferInfo(request)
+	if errInfo != nil {
+		errdef.HandleInternalErrorByCode(response, *errInfo)
+		return
+	}
+	restClient, cfg, err := getConfigs(cInfo)
+	if err != nil {
+		errdef.HandleInternalErrorByCode(response, errdef.ClusterInfoNotFound)
+		return
+	}
+	if errInfo = acquireTransfer(cInfo); errInfo != nil {
+		clog.Warn("transfer of %v to %v/%v rejected: %v", quotaUser(cInfo), cInfo.ClusterName, cInfo.Namespace, errInfo.Msg)
+		errdef.HandleInternalErrorByCode(response, *errInfo)
+		return
+	}
+	defer sessionQuotas.Release(cInfo)
+	id, err := utils.GenTerminalSessionId()
+	if err != nil {
+		errdef.HandleInternalError(response, err)
+		return
+	}
+
+	// the archive headers are set on the first byte, errors before it are sent as json error info
+	stdout := &countingWriter{w: response, start: func() {
+		response.AddHeader("Content-Type", tarContentType)
+		response.AddHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(filePath)+".tar"))
+	}}
+	stderr := &limitedBuffer{limit: maxStderrBytes}
+	cmds := []string{"tar", "cf", "-", "-C", path.Dir(filePath), path.Base(filePath)}
+	clog.Info("[%v] download %v from container %v of pod %v/%v", id, filePath, cInfo.ContainerName, cInfo.Namespace, cInfo.PodName)
+	err = execStream(restClient, cfg, cInfo, cmds, nil, stdout, stderr)
+
+	publishAudit(newAuditMsg(id, cInfo, fmt.Sprintf("download %s, %d bytes", filePath, stdout.n), "download"))
+
+	if err != nil {
+		clog.Error("[%v] download %v failed: %v, stderr: %s", id, filePath, err, stderr.String())
+		// the error can only be reported before any content is sent
+		if stdout.n == 0 {
+			errdef.HandleInternalErrorByCode(response, errdef.FileTransferFailed(err, strings.TrimSpace(stderr.String())))
+		}
+	}
+}
+
+// handleUploadFile extracts the tar archive in request body to the directory in container
+func handleUploadFile(request *restful.Request, response *restful.Response) {
+	cInfo, dirPath, errInfo := getTransferInfo(request)
+	if errInfo != nil {
+		errdef.HandleInternalErrorByCode(response, *errInfo)
+		return
+	}
+	restClient, cfg, err := getConfigs(cInfo)
+	if err != nil {
+		errdef.HandleInternalErrorByCode(response, errdef.ClusterInfoNotFound)
+		return
+	}
+	if errInfo = acquireTransfer(cInfo); errInfo != nil {
+		clog.Warn("transfer of %v to %v/%v rejected: %v", quotaUser(cInfo), cInfo.ClusterName, cInfo.Namespace, errInfo.Msg)
+		errdef.HandleInternalErrorByCode(response, *errInfo)
+		return
+	}
+	defer sessionQuotas.Release(cInfo)
+	id, err := utils.GenTerminalSessionId()
+	if err != nil {
+		errdef.HandleInternalError(response, err)
+		return
+	}
+
+	stdin := &countingReader{r: http.MaxBytesReader(response, request.Request.Body, *fileUploadMaxBytes)}
+	stderr := &limitedBuffer{limit: maxStderrBytes}
+	cmds := []string{"tar", "xmf", "-", "-C", dirPath}
+	clog.Info("[%v] upload to %v of container %v of pod %v/%v", id, dirPath, cInfo.ContainerName, cInfo.Namespace, cInfo.PodName)
+	err = execStream(restClient, cfg, cInfo, cmds, stdin, nil, stderr)
+
+	publishAudit(newAuditMsg(id, cInfo, fmt.Sprintf("upload %s, %d bytes", dirPath, stdin.n), "upload"))
+
+	if err != nil {
+		clog.Error("[%v] upload to %v failed: %v, stderr: %s", id, dirPath, err, stderr.String())
+		errdef.HandleInternalErrorByCode(response, errdef.FileTransferFailed(err, strings.TrimSpace(stderr.String())))
+		return
+	}
+	_ = response.WriteHeaderAndEntity(http.StatusOK, TerminalResponse{Message: fmt.Sprintf("%d bytes uploaded", stdin.n)})
+}
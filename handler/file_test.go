@@ -0,0 +1,67 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCountingWriterStart(t *testing.T) {
+	var buf bytes.Buffer
+	started := 0
+	w := &countingWriter{w: &buf, start: func() { started++ }}
+
+	if _, err := w.Write(nil); err != nil {
+		t.Fatal(err)
+	}
+	if started != 0 {
+		t.Fatal("started without content")
+	}
+	for _, p := range []string{"ab", "cde"} {
+		if _, err := w.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if started != 1 || w.n != 5 || buf.String() != "abcde" {
+		t.Fatalf("got started %d times, %d bytes %q", started, w.n, buf.String())
+	}
+}
+
+func TestAcquireTransfer(t *testing.T) {
+	setQuotas(t, 1, 0, 0, 0)
+	quotas := sessionQuotas
+	sessionQuotas = newSessionQuota()
+	t.Cleanup(func() { sessionQuotas = quotas })
+
+	info := &ConnInfo{ClusterName: "a", Namespace: "default", Owner: "admin"}
+	if errInfo := acquireTransfer(info); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+	if errInfo := acquireTransfer(info); errInfo == nil || errInfo.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %+v, want quota per user exceeded", errInfo)
+	}
+	sessionQuotas.Release(info)
+
+	atomic.StoreInt32(&draining, 1)
+	defer atomic.StoreInt32(&draining, 0)
+	if errInfo := acquireTransfer(info); errInfo == nil || errInfo.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %+v while draining", errInfo)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/kubecube-io/kubecube/pkg/clog"
+)
+
+// Encoding of the Data of stdin and stdout messages, negotiated by the bind message
+const (
+	// EncodingText sends output as json string, incomplete utf-8 sequences are held back until next output
+	// or flushed as replacement characters when the session ends
+	EncodingText = ""
+	// EncodingBase64 sends output and receives input as base64 encoded Data
+	EncodingBase64 = "base64"
+	// EncodingBinary sends output as raw binary frames, input is the same as EncodingText.
+	// It is only supported by /api/websocket, SockJS connections fall back to EncodingBase64.
+	EncodingBinary = "binary"
+)
+
+// binaryConn is implemented by TerminalConn which can send binary frames
+type binaryConn interface {
+	SendBinary([]byte) error
+}
+
+// frameCodec converts process output to messages of the negotiated encoding and decodes user input
+type frameCodec struct {
+	mu       sync.Mutex
+	conn     TerminalConn
+	encoding string
+	pending  []byte
+}
+
+func newFrameCodec(conn TerminalConn, encoding string) *frameCodec {
+	switch encoding {
+	case EncodingText, EncodingBase64:
+	case EncodingBinary:
+		if _, ok := conn.(binaryConn); !ok {
+			encoding = EncodingBase64
+		}
+	default:
+		clog.Warn("unknown encoding %v, use text instead", encoding)
+		encoding = EncodingText
+	}
+	return &frameCodec{conn: conn, encoding: encoding}
+}
+
+// SendOutput sends process output to the connection
+func (c *frameCodec) SendOutput(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.encoding {
+	case EncodingBinary:
+		return c.conn.(binaryConn).SendBinary(p)
+	case EncodingBase64:
+		return c.send(TerminalMessage{Op: "stdout", Data: base64.StdEncoding.EncodeToString(p), Encoding: EncodingBase64})
+	}
+
+	buf := p
+	if len(c.pending) > 0 {
+		buf = append(c.pending, p...)
+		c.pending = nil
+	}
+	n := utf8Boundary(buf)
+	if n < len(buf) {
+		c.pending = append([]byte(nil), buf[n:]...)
+	}
+	if n == 0 {
+		return nil
+	}
+	return c.send(TerminalMessage{Op: "stdout", Data: string(buf[:n])})
+}
+
+// Flush sends the incomplete utf-8 sequence held back from the last output before the connection
+// is closed, the client gets it as replacement characters instead of losing it silently
+func (c *frameCodec) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		return nil
+	}
+	data := string(c.pending)
+	c.pending = nil
+	return c.send(TerminalMessage{Op: "stdout", Data: data})
+}
+
+// DecodeInput decodes Data of stdin message
+func (c *frameCodec) DecodeInput(data string) (string, error) {
+	if c.encoding != EncodingBase64 {
+		return data, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (c *frameCodec) send(msg TerminalMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.conn.Send(string(b))
+}
+
+// utf8Boundary returns the length of p without a trailing incomplete utf-8 sequence,
+// invalid bytes are not held back
+func utf8Boundary(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if utf8.FullRune(p[i:]) {
+				return len(p)
+			}
+			return i
+		}
+	}
+	return len(p)
+}
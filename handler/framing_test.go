@@ -0,0 +1,113 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// recordConn is a TerminalConn which records the sent messages
+type recordConn struct {
+	sent []string
+}
+
+func (c *recordConn) Recv() (string, error) { return "", nil }
+
+func (c *recordConn) Send(s string) error {
+	c.sent = append(c.sent, s)
+	return nil
+}
+
+func (c *recordConn) Close(status uint32, reason string) error { return nil }
+
+// outputs returns Data of the stdout messages sent
+func (c *recordConn) outputs(t *testing.T) []string {
+	t.Helper()
+	var data []string
+	for _, s := range c.sent {
+		var msg TerminalMessage
+		if err := json.Unmarshal([]byte(s), &msg); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, msg.Data)
+	}
+	return data
+}
+
+func TestUTF8Boundary(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"ls", 2},
+		{"你好", 6},
+		{"ls \xe4", 3},
+		{"ls \xe4\xbd", 3},
+		{"ls \xf0\x9f\x98", 3},
+		{"ls \xf0\x9f\x98\x80", 7},
+		// invalid bytes are sent as they are
+		{"ls \xbd", 4},
+		{"ls \xff", 4},
+		{"\xbd\xbd\xbd\xbd\xbd", 5},
+	}
+	for _, tt := range tests {
+		if got := utf8Boundary([]byte(tt.in)); got != tt.want {
+			t.Errorf("utf8Boundary(%q): got %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFrameCodecText(t *testing.T) {
+	conn := &recordConn{}
+	c := newFrameCodec(conn, EncodingText)
+	for _, p := range []string{"echo \xe4", "\xbd", "\xa0\xe5\xa5\xbd\n", "\xe4"} {
+		if err := c.SendOutput([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"echo ", "你好\n", "�"}
+	got := conn.outputs(t)
+	if len(got) != len(want) {
+		t.Fatalf("got outputs %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got outputs %q, want %q", got, want)
+		}
+	}
+}
+
+func TestFrameCodecFallback(t *testing.T) {
+	c := newFrameCodec(&recordConn{}, EncodingBinary)
+	if c.encoding != EncodingBase64 {
+		t.Fatalf("got encoding %q for a connection without binary frames", c.encoding)
+	}
+	if c = newFrameCodec(&recordConn{}, "utf-16"); c.encoding != EncodingText {
+		t.Fatalf("got encoding %q for unknown encoding", c.encoding)
+	}
+	if data, err := c.DecodeInput("bHM="); err != nil || data != "bHM=" {
+		t.Fatalf("got %q, %v decoding text", data, err)
+	}
+}
@@ -17,8 +17,9 @@ package handler
 
 import (
 	"github.com/patrickmn/go-cache"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
-	"net/http"
+	"os"
 	"time"
 )
 
@@ -28,23 +29,110 @@ func initConfig() {
 	configMap = cache.New(5*time.Minute, 5*time.Minute)
 }
 
+func initSession() {
+	switch *sessionStore {
+	case SessionStoreMemory:
+		sessions = NewSessionRegistry(*sessionBindTimeout)
+	case SessionStoreKubernetes:
+		store, err := newKubeSessionStore(*appNamespace, *sessionBindTimeout)
+		if err != nil {
+			klog.Fatalf("init kubernetes session store failed: %v", err)
+		}
+		sessions = store
+	default:
+		klog.Fatalf("unknown session store %v", *sessionStore)
+	}
+	liveSessions = NewLiveSessionIndex()
+	drainConns = newConnRegistry()
+	sessionQuotas = newSessionQuota()
+	if *sessionStore == SessionStoreKubernetes {
+		// sessions are shared by replicas, so only the leader removes expired ones
+		registerLeaderTask("expire sessions", sessions.Expire, *sessionBindTimeout)
+	} else {
+		go wait.Until(sessions.Expire, *sessionBindTimeout, wait.NeverStop)
+	}
+	if *ActiveActive && *sessionStore == SessionStoreMemory {
+		klog.Warningf("active-active mode with memory session store, session ids can only be bound by the replica issued them")
+	}
+
+	var err error
+	if sessionIdleTimeoutList, err = parseScopedDurations(*sessionIdleTimeouts); err != nil {
+		klog.Fatalf("parse session idle timeouts failed: %v", err)
+	}
+	if sessionMaxDurationList, err = parseScopedDurations(*sessionMaxDurations); err != nil {
+		klog.Fatalf("parse session max durations failed: %v", err)
+	}
+}
+
+func initShell() {
+	defaultShellList = parseShells(*shells)
+	list, err := parseImageShells(*imageShells)
+	if err != nil {
+		klog.Fatalf("parse image shells failed: %v", err)
+	}
+	imageShellList = list
+}
+
+func initRecord() {
+	if !*enableRecord {
+		return
+	}
+	recordScopeList = parseScopeList(*recordScopes)
+	if err := os.MkdirAll(*recordDir, 0700); err != nil {
+		klog.Errorf("create record dir %v failed, %v", *recordDir, err)
+	}
+	klog.Infof("session record enabled, dir: %v, scopes: %v", *recordDir, *recordScopes)
+}
+
+func initDebug() {
+	if !*enableDebug {
+		return
+	}
+	debugScopeList = parseScopeList(*debugScopes)
+	klog.Infof("debug session enabled, image: %v, scopes: %v", *debugImage, *debugScopes)
+}
+
+func initPortForward() {
+	if *portForwardPorts == "" {
+		return
+	}
+	list, err := parsePortList(*portForwardPorts)
+	if err != nil {
+		klog.Fatalf("parse port-forward ports failed: %v", err)
+	}
+	portForwardPortList = list
+	klog.Infof("port-forward enabled, ports: %v", *portForwardPorts)
+}
+
+func initCommandPolicy() {
+	if *commandPolicyConfigMap == "" {
+		return
+	}
+	loader := &commandPolicyLoader{}
+	go wait.Until(loader.Reload, *commandPolicyResync, wait.NeverStop)
+	klog.Infof("command policy enabled, configmap: %v/%v", *appNamespace, *commandPolicyConfigMap)
+}
+
+func initRedact() {
+	redactors, err := newRedactors(*auditRedactorNames, auditRedactPatterns)
+	if err != nil {
+		klog.Fatalf("init audit redactors failed: %v", err)
+	}
+	auditRedactors = redactors
+}
+
 func initAudit() {
 	if !*enableAudit {
 		klog.Info("audit disabled")
 		return
 	}
 
-	// 初始化http client
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: MaxIdlePerHost,
-		},
-		Timeout: RequestTimeout * time.Second,
+	sinks, err := newAuditSinks(*auditSinkNames)
+	if err != nil {
+		klog.Fatalf("init audit sinks failed: %v", err)
+	}
+	if auditSinks, err = newAuditFanout(sinks, *auditSinkQueueSize, *auditSpoolDir); err != nil {
+		klog.Fatalf("init audit spool failed: %v", err)
 	}
-	AuditAdapter = &auditAdapter{}
-	AuditAdapter.HttpClient = httpClient
-	AuditAdapter.URL = *auditURL
-	AuditAdapter.Method = *auditMethod
-	AuditAdapter.Header = *auditHeader
-	klog.Infof("audit init success, url: %v", AuditAdapter.URL)
+	klog.Infof("audit init success, sinks: %v, spool: %v", *auditSinkNames, *auditSpoolDir)
 }
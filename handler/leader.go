@@ -0,0 +1,47 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// leaderTask is a background task which must run on one replica only
+type leaderTask struct {
+	name     string
+	fn       func()
+	interval time.Duration
+}
+
+// leaderTasks are registered by Init and run by the elected leader
+var leaderTasks []leaderTask
+
+func registerLeaderTask(name string, fn func(), interval time.Duration) {
+	leaderTasks = append(leaderTasks, leaderTask{name: name, fn: fn, interval: interval})
+}
+
+// RunLeaderTasks is called once the replica becomes leader, the tasks run until ctx is done
+func RunLeaderTasks(ctx context.Context) {
+	for _, task := range leaderTasks {
+		clog.Info("start leader task %v, interval %v", task.name, task.interval)
+		go wait.Until(task.fn, task.interval, ctx.Done())
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	utilexec "k8s.io/client-go/util/exec"
+	"kubecube-webconsole/errdef"
+)
+
+// data types of session lifecycle audit messages, their details are in AuditMsg.Event
+const (
+	AuditSessionCreated = "session_created"
+	AuditSessionBound   = "session_bound"
+	AuditShellSelected  = "shell_selected"
+	AuditSessionResized = "session_resized"
+	AuditSessionClosed  = "session_closed"
+)
+
+// status codes of closing a session, sent to the client with the reason
+const (
+	CloseStatusExited      = 1
+	CloseStatusError       = 2
+	CloseStatusTerminated  = 3
+	CloseStatusIdleTimeout = 4
+	CloseStatusMaxDuration = 5
+	CloseStatusShutdown    = 6
+)
+
+// SessionEvent is the detail of a session lifecycle audit message
+type SessionEvent struct {
+	Kind            string  `json:"kind,omitempty"`
+	Owner           string  `json:"owner,omitempty"`
+	Container       string  `json:"container,omitempty"`
+	Node            string  `json:"node,omitempty"`
+	Port            uint16  `json:"port,omitempty"`
+	WatchSession    string  `json:"watch_session,omitempty"`
+	Shell           string  `json:"shell,omitempty"`
+	Rows            uint16  `json:"rows,omitempty"`
+	Cols            uint16  `json:"cols,omitempty"`
+	CloseStatus     uint32  `json:"close_status,omitempty"`
+	CloseReason     string  `json:"close_reason,omitempty"`
+	ExitCode        *int    `json:"exit_code,omitempty"` // exit code of the process, nil if it is unknown
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	BytesIn         int64   `json:"bytes_in,omitempty"`
+	BytesOut        int64   `json:"bytes_out,omitempty"`
+}
+
+func newSessionEvent(info *ConnInfo) *SessionEvent {
+	kind := info.Kind
+	if kind == SessionKindExec {
+		kind = "exec"
+	}
+	return &SessionEvent{
+		Kind:         kind,
+		Owner:        info.Owner,
+		Container:    info.ContainerName,
+		Node:         info.NodeName,
+		Port:         info.Port,
+		WatchSession: info.WatchSession,
+	}
+}
+
+// auditSessionEvent publishes a lifecycle audit message of session id
+func auditSessionEvent(id string, info *ConnInfo, dataType string, data string, event *SessionEvent) {
+	msg := newAuditMsg(id, info, data, dataType)
+	msg.Event = event
+	publishAudit(msg)
+}
+
+// issueSession issues a session id for info and audits the creation,
+// errdef.ErrorInfo is returned if the session quota is used up or the server is shutting down
+func issueSession(info *ConnInfo) (string, error) {
+	if IsDraining() {
+		return "", errdef.ServerShuttingDown
+	}
+	// only the user who requested the session can bind it
+	if info.Owner == "" {
+		return "", *errdef.InvalidToken
+	}
+	if errInfo := sessionQuotas.Check(info); errInfo != nil {
+		clog.Warn("session of %v to %v/%v rejected: %v", quotaUser(info), info.ClusterName, info.Namespace, errInfo.Msg)
+		return "", *errInfo
+	}
+	id, err := sessions.Issue(info)
+	if err != nil {
+		return "", err
+	}
+	auditSessionEvent(id, info, AuditSessionCreated, "session created", newSessionEvent(info))
+	return id, nil
+}
+
+// auditSessionClosed audits the end of session id, err is what the session ended with
+// and stats may be nil if nothing is transferred
+func auditSessionClosed(id string, info *ConnInfo, stats *sessionStats, status uint32, reason string, err error) {
+	event := newSessionEvent(info)
+	event.CloseStatus, event.CloseReason = status, reason
+	if runsProcess(info) && status <= CloseStatusError {
+		event.ExitCode = exitCode(err)
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if stats != nil {
+		event.DurationSeconds = time.Since(stats.startTime).Seconds()
+		event.BytesIn = atomic.LoadInt64(&stats.bytesIn)
+		event.BytesOut = atomic.LoadInt64(&stats.bytesOut)
+	}
+	clog.Info("session %v closed with status %d: %v", id, status, reason)
+	auditSessionEvent(id, info, AuditSessionClosed, fmt.Sprintf("session closed: %s", reason), event)
+}
+
+// runsProcess returns true if the session runs a process in the container
+func runsProcess(info *ConnInfo) bool {
+	return info.WatchSession == "" && info.Kind != SessionKindLog && info.Kind != SessionKindPortForward
+}
+
+// exitCode returns the exit code of the process the session ran, nil if err is not an exit error
+func exitCode(err error) *int {
+	code := 0
+	if err == nil {
+		return &code
+	}
+	var exitErr utilexec.ExitError
+	if !errors.As(err, &exitErr) {
+		return nil
+	}
+	code = exitErr.ExitStatus()
+	return &code
+}
+
+// sessionCloser is shared by all copies of a TerminalSession, the first close wins
+type sessionCloser struct {
+	once   sync.Once
+	status uint32
+	reason string
+}
+
+func (c *sessionCloser) close(status uint32, reason string, fn func()) {
+	c.once.Do(func() {
+		c.status, c.reason = status, reason
+		fn()
+	})
+}
@@ -0,0 +1,580 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxEchoLine limits the runes of the echoed line kept, the rest of a longer line is ignored
+	maxEchoLine = 4096
+	// echoWaitTimeout limits waiting for the echo of an uncertain line before it is submitted
+	echoWaitTimeout  = 300 * time.Millisecond
+	echoPollInterval = 10 * time.Millisecond
+)
+
+// bracketed paste markers, xterm sends them around pasted text once the shell enables the mode
+const (
+	pasteStart = "200"
+	pasteEnd   = "201"
+)
+
+// reverseSearchPrompt is what bash echoes during Ctrl-R, the line is replaced by the match
+var reverseSearchPrompt = regexp.MustCompile("\\((?:failed )?reverse-i-search\\)`[^']*': (.*)$")
+
+// escToken is a rune or an escape sequence of a terminal stream
+type escToken struct {
+	r      rune   // the rune, or the final byte of an escape sequence
+	seq    byte   // 0 for a rune, '[' for CSI, 'O' for SS3, escape for ESC followed by r
+	params string // parameters of CSI
+}
+
+const escape = 0x1b
+
+const (
+	escNone = iota
+	escStart
+	escCSI
+	escSS3
+	escOSC
+	escOSCEnd
+)
+
+// escParser splits a terminal stream into tokens, a sequence may span several chunks.
+// OSC sequences such as window titles set by prompts are dropped.
+type escParser struct {
+	state  int
+	params strings.Builder
+}
+
+// feed returns the token completed by r
+func (p *escParser) feed(r rune) (escToken, bool) {
+	switch p.state {
+	case escStart:
+		switch r {
+		case '[':
+			p.state = escCSI
+			p.params.Reset()
+		case 'O':
+			p.state = escSS3
+		case ']':
+			p.state = escOSC
+		default:
+			p.state = escNone
+			return escToken{r: r, seq: escape}, true
+		}
+	case escCSI:
+		switch {
+		case r >= 0x20 && r <= 0x3f:
+			p.params.WriteRune(r)
+		case r >= 0x40 && r <= 0x7e:
+			p.state = escNone
+			return escToken{r: r, seq: '[', params: p.params.String()}, true
+		default:
+			// broken sequence
+			p.state = escNone
+			return escToken{r: r}, true
+		}
+	case escSS3:
+		p.state = escNone
+		return escToken{r: r, seq: 'O'}, true
+	case escOSC:
+		switch r {
+		case '\a':
+			p.state = escNone
+		case escape:
+			p.state = escOSCEnd
+		}
+	case escOSCEnd:
+		if r == '\\' {
+			p.state = escNone
+		} else {
+			p.state = escOSC
+		}
+	default:
+		if r == escape {
+			p.state = escStart
+			return escToken{}, false
+		}
+		return escToken{r: r}, true
+	}
+	return escToken{}, false
+}
+
+// csiParam returns the first numeric parameter of a CSI sequence, or def if it is missing
+func csiParam(params string, def int) int {
+	params = strings.TrimLeft(params, "?>=<")
+	if i := strings.IndexByte(params, ';'); i >= 0 {
+		params = params[:i]
+	}
+	n, err := strconv.Atoi(params)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// echoLine tracks the terminal line where the cursor is, as much as needed to
+// read the command line echoed by the shell
+type echoLine struct {
+	text []rune
+	col  int
+}
+
+func (l *echoLine) apply(tok escToken) {
+	switch tok.seq {
+	case 0:
+		switch r := tok.r; {
+		case r == '\r':
+			l.col = 0
+		case r == '\n':
+			l.text, l.col = l.text[:0], 0
+		case r == '\b':
+			l.moveTo(l.col - 1)
+		case r == '\t':
+			l.moveTo((l.col/8 + 1) * 8)
+		case r < 0x20 || r == 0x7f:
+			// bell and other controls are not shown
+		default:
+			l.put(r)
+		}
+	case '[':
+		n := csiParam(tok.params, 1)
+		if n == 0 {
+			n = 1
+		}
+		switch tok.r {
+		case 'C':
+			l.moveTo(l.col + n)
+		case 'D':
+			l.moveTo(l.col - n)
+		case 'G':
+			l.moveTo(n - 1)
+		case 'K':
+			switch csiParam(tok.params, 0) {
+			case 0:
+				if l.col < len(l.text) {
+					l.text = l.text[:l.col]
+				}
+			case 1:
+				l.blank(0, l.col+1)
+			case 2:
+				l.text = l.text[:0]
+			}
+		case 'P':
+			if l.col < len(l.text) {
+				end := l.col + n
+				if end > len(l.text) {
+					end = len(l.text)
+				}
+				l.text = append(l.text[:l.col], l.text[end:]...)
+			}
+		case '@':
+			if l.col < len(l.text) {
+				spaces := []rune(strings.Repeat(" ", n))
+				l.text = append(l.text[:l.col], append(spaces, l.text[l.col:]...)...)
+			}
+		case 'X':
+			l.blank(l.col, l.col+n)
+		}
+	}
+}
+
+func (l *echoLine) moveTo(col int) {
+	switch {
+	case col < 0:
+		col = 0
+	case col > maxEchoLine:
+		col = maxEchoLine
+	}
+	l.col = col
+}
+
+func (l *echoLine) put(r rune) {
+	if l.col >= maxEchoLine {
+		return
+	}
+	for len(l.text) < l.col {
+		l.text = append(l.text, ' ')
+	}
+	if l.col < len(l.text) {
+		l.text[l.col] = r
+	} else {
+		l.text = append(l.text, r)
+	}
+	l.col++
+}
+
+func (l *echoLine) blank(from, to int) {
+	for i := from; i < to && i < len(l.text); i++ {
+		l.text[i] = ' '
+	}
+}
+
+func (l *echoLine) String() string {
+	return string(l.text)
+}
+
+// left returns the text left of the cursor
+func (l *echoLine) left() string {
+	if l.col < len(l.text) {
+		return string(l.text[:l.col])
+	}
+	return string(l.text)
+}
+
+// editedLine is a command line submitted by enter
+type editedLine struct {
+	Command    string
+	Keystrokes string // raw keystrokes of the line, including those of previous chunks
+	Start      int    // offset in the chunk where keystrokes of the line begin, 0 if it began in previous chunks
+}
+
+// lineEditor reconstructs the command lines a shell executes from stdin keystrokes
+// by emulating the editing keys of readline. Keys whose effect only the shell knows,
+// such as tab completion and history recall, make the line uncertain, the command
+// is then read from what the shell echoes to stdout after the prompt. If enter follows
+// such a key before the shell echoed, the input from enter on is held until the echo arrives.
+type lineEditor struct {
+	mu sync.Mutex
+
+	input     escParser
+	buf       []rune
+	cursor    int
+	killed    []rune // the last killed text, inserted by Ctrl-Y
+	raw       strings.Builder
+	started   bool
+	uncertain bool
+	pasting   bool
+	prompt    string // echo left of the cursor when the line started
+	held      string // input from the enter of an uncertain line not echoed yet
+
+	output  escParser
+	pending []byte // partial UTF-8 sequence at the end of the last output
+	echo    echoLine
+	echoed  bool // output arrived since the line became uncertain
+	noEcho  bool // the echo of the line did not arrive in time, the command is read from buf
+}
+
+func newLineEditor() *lineEditor {
+	return &lineEditor{}
+}
+
+// Input feeds stdin of the session and returns the lines submitted in data and the bytes of
+// data consumed, the rest is held until the shell echoes the line and returned by Held
+func (e *lineEditor) Input(data string) ([]editedLine, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var lines []editedLine
+	start := 0
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRuneInString(data[i:])
+		if e.awaitsEcho(r) {
+			e.held = data[i:]
+			return lines, i
+		}
+		i += size
+		if !e.started {
+			e.started = true
+			e.prompt = e.echo.left()
+		}
+		e.raw.WriteRune(r)
+		tok, ok := e.input.feed(r)
+		if !ok || !e.key(tok) {
+			continue
+		}
+		lines = append(lines, editedLine{Command: e.command(), Keystrokes: e.raw.String(), Start: start})
+		start = i
+		e.resetLine()
+	}
+	return lines, len(data)
+}
+
+// awaitsEcho returns true if r submits an uncertain line the shell has not echoed yet
+func (e *lineEditor) awaitsEcho(r rune) bool {
+	return (r == '\r' || r == '\n') && e.uncertain && !e.echoed && !e.noEcho && !e.pasting && e.input.state == escNone
+}
+
+// Held waits up to timeout for the echo of the line and returns the input held by Input,
+// it returns an empty string if nothing is held
+func (e *lineEditor) Held(timeout time.Duration) string {
+	deadline := time.Now().Add(timeout)
+	for {
+		e.mu.Lock()
+		held := e.held
+		if held == "" {
+			e.mu.Unlock()
+			return ""
+		}
+		if e.echoed || time.Now().After(deadline) {
+			e.held, e.noEcho = "", !e.echoed
+			e.mu.Unlock()
+			return held
+		}
+		e.mu.Unlock()
+		time.Sleep(echoPollInterval)
+	}
+}
+
+// Output feeds stdout of the session to follow the echo of the shell
+func (e *lineEditor) Output(p []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.echoed = true
+	data := p
+	if len(e.pending) > 0 {
+		data = append(e.pending, p...)
+		e.pending = nil
+	}
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			e.pending = append([]byte(nil), data...)
+			return
+		}
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+		if tok, ok := e.output.feed(r); ok {
+			e.echo.apply(tok)
+		}
+	}
+}
+
+// Reset discards the line being edited
+func (e *lineEditor) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.input = escParser{}
+	e.held = ""
+	e.resetLine()
+}
+
+func (e *lineEditor) resetLine() {
+	e.buf, e.cursor = nil, 0
+	e.raw.Reset()
+	e.started, e.uncertain, e.pasting, e.noEcho = false, false, false, false
+}
+
+// command returns the submitted command, the echo is preferred if the line is uncertain and echoed
+func (e *lineEditor) command() string {
+	if e.uncertain && !e.noEcho {
+		text := e.echo.String()
+		if m := reverseSearchPrompt.FindStringSubmatch(text); m != nil {
+			return m[1]
+		}
+		if text != "" && strings.HasPrefix(text, e.prompt) {
+			return strings.TrimRight(strings.TrimPrefix(text, e.prompt), " ")
+		}
+	}
+	return string(e.buf)
+}
+
+// key applies tok to the line and returns true if the line is submitted
+func (e *lineEditor) key(tok escToken) bool {
+	if e.pasting {
+		switch {
+		case tok.seq == '[' && tok.r == '~' && tok.params == pasteEnd:
+			e.pasting = false
+		case tok.seq == 0 && tok.r == '\r':
+			// pasted lines stay in the buffer until enter is pressed
+			e.insert([]rune{'\n'})
+		case tok.seq == 0:
+			e.insert([]rune{tok.r})
+		}
+		return false
+	}
+
+	switch tok.seq {
+	case 0:
+		return e.control(tok.r)
+	case escape:
+		e.meta(tok.r)
+	case '[', 'O':
+		e.cursorKey(tok)
+	}
+	return false
+}
+
+func (e *lineEditor) control(r rune) bool {
+	switch r {
+	case '\r', '\n':
+		return true
+	case 0x7f, '\b':
+		if e.cursor > 0 {
+			e.delete(e.cursor-1, e.cursor)
+		}
+	case 0x01: // Ctrl-A
+		e.cursor = 0
+	case 0x05: // Ctrl-E
+		e.cursor = len(e.buf)
+	case 0x02: // Ctrl-B
+		if e.cursor > 0 {
+			e.cursor--
+		}
+	case 0x06: // Ctrl-F
+		if e.cursor < len(e.buf) {
+			e.cursor++
+		}
+	case 0x04: // Ctrl-D deletes the rune under the cursor, it exits the shell on an empty line
+		if e.cursor < len(e.buf) {
+			e.delete(e.cursor, e.cursor+1)
+		}
+	case 0x0b: // Ctrl-K
+		e.kill(e.cursor, len(e.buf))
+	case 0x15: // Ctrl-U
+		e.kill(0, e.cursor)
+	case 0x17: // Ctrl-W kills the previous whitespace delimited word
+		e.kill(e.wordLeft(unicode.IsSpace), e.cursor)
+	case 0x19: // Ctrl-Y
+		e.insert(e.killed)
+	case 0x03: // Ctrl-C
+		e.resetLine()
+	case 0x0c: // Ctrl-L clears the screen and keeps the line
+	default:
+		if r < 0x20 {
+			// tab, Ctrl-P, Ctrl-N, Ctrl-R and other keys the shell decides
+			e.markUncertain()
+			return false
+		}
+		e.insert([]rune{r})
+	}
+	return false
+}
+
+// meta handles keys pressed with Alt
+func (e *lineEditor) meta(r rune) {
+	switch r {
+	case 'b':
+		e.cursor = e.wordLeft(notWordRune)
+	case 'f':
+		e.cursor = e.wordRight()
+	case 'd':
+		e.kill(e.cursor, e.wordRight())
+	case 0x7f, '\b':
+		e.kill(e.wordLeft(notWordRune), e.cursor)
+	default:
+		e.markUncertain()
+	}
+}
+
+func (e *lineEditor) cursorKey(tok escToken) {
+	// a modifier such as "1;5" of Ctrl-Left moves by words
+	word := strings.Contains(tok.params, ";")
+	switch tok.r {
+	case 'C':
+		if word {
+			e.cursor = e.wordRight()
+		} else if e.cursor < len(e.buf) {
+			e.cursor++
+		}
+	case 'D':
+		if word {
+			e.cursor = e.wordLeft(notWordRune)
+		} else if e.cursor > 0 {
+			e.cursor--
+		}
+	case 'H':
+		e.cursor = 0
+	case 'F':
+		e.cursor = len(e.buf)
+	case '~':
+		switch tok.params {
+		case "1", "7":
+			e.cursor = 0
+		case "4", "8":
+			e.cursor = len(e.buf)
+		case "3":
+			if e.cursor < len(e.buf) {
+				e.delete(e.cursor, e.cursor+1)
+			}
+		case "2":
+			// insert key
+		case pasteStart:
+			e.pasting = true
+		default:
+			e.markUncertain()
+		}
+	default:
+		// up and down recall history, the shell decides other keys
+		e.markUncertain()
+	}
+}
+
+// markUncertain makes the command read from the echo which follows the key
+func (e *lineEditor) markUncertain() {
+	e.uncertain, e.echoed = true, false
+}
+
+func (e *lineEditor) insert(runes []rune) {
+	if len(runes) == 0 {
+		return
+	}
+	buf := make([]rune, 0, len(e.buf)+len(runes))
+	buf = append(buf, e.buf[:e.cursor]...)
+	buf = append(buf, runes...)
+	e.buf = append(buf, e.buf[e.cursor:]...)
+	e.cursor += len(runes)
+}
+
+func (e *lineEditor) delete(from, to int) {
+	e.buf = append(e.buf[:from], e.buf[to:]...)
+	e.cursor = from
+}
+
+func (e *lineEditor) kill(from, to int) {
+	if from >= to {
+		return
+	}
+	e.killed = append([]rune(nil), e.buf[from:to]...)
+	e.delete(from, to)
+}
+
+// wordLeft returns the start of the word before the cursor, runes matching sep delimit words
+func (e *lineEditor) wordLeft(sep func(rune) bool) int {
+	i := e.cursor
+	for i > 0 && sep(e.buf[i-1]) {
+		i--
+	}
+	for i > 0 && !sep(e.buf[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordRight returns the end of the word after the cursor
+func (e *lineEditor) wordRight() int {
+	i := e.cursor
+	for i < len(e.buf) && notWordRune(e.buf[i]) {
+		i++
+	}
+	for i < len(e.buf) && !notWordRune(e.buf[i]) {
+		i++
+	}
+	return i
+}
+
+func notWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
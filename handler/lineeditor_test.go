@@ -0,0 +1,212 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+// editorStep is stdin or stdout of a session, exactly one is set
+type editorStep struct {
+	in  string
+	out string
+}
+
+func TestLineEditor(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []editorStep
+		want  []string
+	}{
+		{
+			name:  "plain",
+			steps: []editorStep{{out: "$ "}, {in: "ls -l\r"}},
+			want:  []string{"ls -l"},
+		},
+		{
+			name:  "backspace",
+			steps: []editorStep{{in: "lss\x7f -l\x08\x08-l\r"}},
+			want:  []string{"ls -l"},
+		},
+		{
+			name:  "ctrl-u kills to the start",
+			steps: []editorStep{{in: "rm -rf /\x15ls\r"}},
+			want:  []string{"ls"},
+		},
+		{
+			name:  "ctrl-w kills a word",
+			steps: []editorStep{{in: "echo foo bar\x17baz\r"}},
+			want:  []string{"echo foo baz"},
+		},
+		{
+			name:  "ctrl-y yanks the killed word",
+			steps: []editorStep{{in: "ls /tmp\x17\x19\x19\r"}},
+			want:  []string{"ls /tmp/tmp"},
+		},
+		{
+			name:  "ctrl-c discards the line",
+			steps: []editorStep{{in: "rm -rf /\x03ls\r"}},
+			want:  []string{"ls"},
+		},
+		{
+			name:  "arrows move the cursor",
+			steps: []editorStep{{in: "l -l\x1b[D\x1b[D\x1b[Ds\x1b[C\x1b[C\x1b[Ca\r"}},
+			want:  []string{"ls -la"},
+		},
+		{
+			name:  "ctrl-left moves by words",
+			steps: []editorStep{{in: "echo world\x1b[1;5Dhello \r"}},
+			want:  []string{"echo hello world"},
+		},
+		{
+			name:  "lines of one chunk",
+			steps: []editorStep{{in: "cd /\rls\r"}},
+			want:  []string{"cd /", "ls"},
+		},
+		{
+			name:  "history is read from the echo",
+			steps: []editorStep{{out: "$ "}, {in: "\x1b[A"}, {out: "ls -la"}, {in: "\r"}},
+			want:  []string{"ls -la"},
+		},
+		{
+			name:  "history replaced after editing",
+			steps: []editorStep{{out: "$ "}, {in: "rm"}, {out: "rm"}, {in: "\x1b[A"}, {out: "\r$ \x1b[Kcat /etc/hosts"}, {in: "\r"}},
+			want:  []string{"cat /etc/hosts"},
+		},
+		{
+			name:  "tab completion is read from the echo",
+			steps: []editorStep{{out: "$ "}, {in: "cat /et"}, {out: "cat /et"}, {in: "\t"}, {out: "c/"}, {in: "\r"}},
+			want:  []string{"cat /etc/"},
+		},
+		{
+			name:  "reverse search is read from the echo",
+			steps: []editorStep{{out: "$ "}, {in: "\x12"}, {out: "\r(reverse-i-search)`': "}, {in: "rm"}, {out: "\r(reverse-i-search)`rm': rm -rf /tmp/x"}, {in: "\r"}},
+			want:  []string{"rm -rf /tmp/x"},
+		},
+		{
+			name:  "bracketed paste keeps lines until enter",
+			steps: []editorStep{{in: "\x1b[200~echo a\recho b\x1b[201~\r"}},
+			want:  []string{"echo a\necho b"},
+		},
+		{
+			name:  "escape sequence split across chunks",
+			steps: []editorStep{{in: "ls -x\x1b"}, {in: "["}, {in: "D"}, {in: "a\r"}},
+			want:  []string{"ls -ax"},
+		},
+		{
+			name:  "paste split across chunks",
+			steps: []editorStep{{in: "\x1b[20"}, {in: "0~rm -rf /\r"}, {in: "\x1b[201~"}, {in: "\r"}},
+			want:  []string{"rm -rf /\n"},
+		},
+		{
+			name:  "echo split inside a rune",
+			steps: []editorStep{{out: "$ "}, {in: "\t"}, {out: "echo \xe4\xbd"}, {out: "\xa0\xe5\xa5\xbd"}, {in: "\r"}},
+			want:  []string{"echo 你好"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newLineEditor()
+			var got []string
+			for _, step := range tt.steps {
+				if step.out != "" {
+					e.Output([]byte(step.out))
+					continue
+				}
+				lines, n := e.Input(step.in)
+				if n != len(step.in) {
+					t.Fatalf("input %q is held from %d", step.in, n)
+				}
+				for _, line := range lines {
+					got = append(got, line.Command)
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("got commands %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineEditorStart(t *testing.T) {
+	e := newLineEditor()
+	data := "cd /\rrm -rf /\r"
+	lines, _ := e.Input(data)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	if lines[0].Start != 0 || data[lines[1].Start:] != "rm -rf /\r" {
+		t.Fatalf("got line starts %d and %d", lines[0].Start, lines[1].Start)
+	}
+	if lines[1].Keystrokes != "rm -rf /\r" {
+		t.Fatalf("got keystrokes %q", lines[1].Keystrokes)
+	}
+}
+
+func TestLineEditorHoldsUntilEcho(t *testing.T) {
+	e := newLineEditor()
+	e.Output([]byte("$ "))
+
+	// enter comes with the tab, before the shell completed the line
+	data := "cat /et\t\r"
+	lines, n := e.Input(data)
+	if len(lines) != 0 || data[n:] != "\r" {
+		t.Fatalf("got %d lines and %q held, want the enter held", len(lines), data[n:])
+	}
+
+	e.Output([]byte("cat /etc/"))
+	held := e.Held(echoWaitTimeout)
+	if held != "\r" {
+		t.Fatalf("got %q held", held)
+	}
+	lines, n = e.Input(held)
+	if n != len(held) || len(lines) != 1 || lines[0].Command != "cat /etc/" {
+		t.Fatalf("got lines %+v", lines)
+	}
+	if e.Held(echoWaitTimeout) != "" {
+		t.Fatal("input is still held")
+	}
+}
+
+func TestLineEditorEchoTimeout(t *testing.T) {
+	e := newLineEditor()
+	e.Output([]byte("$ "))
+
+	lines, n := e.Input("rm -rf /tm\t\r")
+	if len(lines) != 0 {
+		t.Fatalf("got lines %+v before echo", lines)
+	}
+	held := e.Held(0)
+	if n != len("rm -rf /tm\t") || held != "\r" {
+		t.Fatalf("got %q held", held)
+	}
+	// the shell never echoed, the typed line is submitted
+	lines, _ = e.Input(held)
+	if len(lines) != 1 || lines[0].Command != "rm -rf /tm" {
+		t.Fatalf("got lines %+v", lines)
+	}
+}
+
+func TestLineEditorResetDropsHeld(t *testing.T) {
+	e := newLineEditor()
+	e.Input("ls\t\r")
+	e.Reset()
+	if held := e.Held(0); held != "" {
+		t.Fatalf("got %q held after reset", held)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	"kubecube-webconsole/errdef"
+	"kubecube-webconsole/utils"
+)
+
+// sessionStats is shared by all copies of a TerminalSession, int64 fields must be accessed atomically
+type sessionStats struct {
+	bytesIn      int64
+	bytesOut     int64
+	lastActivity int64 // unix nano
+	startTime    time.Time
+}
+
+func newSessionStats() *sessionStats {
+	now := time.Now()
+	return &sessionStats{lastActivity: now.UnixNano(), startTime: now}
+}
+
+func (s *sessionStats) addIn(n int) {
+	atomic.AddInt64(&s.bytesIn, int64(n))
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+func (s *sessionStats) addOut(n int) {
+	atomic.AddInt64(&s.bytesOut, int64(n))
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// LiveSession is a snapshot of a running terminal session
+type LiveSession struct {
+	ID           string    `json:"id"`
+	Kind         string    `json:"kind,omitempty"`
+	User         string    `json:"user,omitempty"`
+	Cluster      string    `json:"cluster"`
+	Namespace    string    `json:"namespace"`
+	Pod          string    `json:"pod"`
+	Container    string    `json:"container"`
+	Node         string    `json:"node,omitempty"`
+	StartTime    time.Time `json:"startTime"`
+	LastActivity time.Time `json:"lastActivity"`
+	BytesIn      int64     `json:"bytesIn"`
+	BytesOut     int64     `json:"bytesOut"`
+	Watchers     int       `json:"watchers"`
+}
+
+// LiveSessionIndex indexes running terminal sessions by session id
+type LiveSessionIndex struct {
+	mu       sync.RWMutex
+	sessions map[string]*TerminalSession
+}
+
+func NewLiveSessionIndex() *LiveSessionIndex {
+	return &LiveSessionIndex{sessions: make(map[string]*TerminalSession)}
+}
+
+func (l *LiveSessionIndex) Add(t *TerminalSession) {
+	l.mu.Lock()
+	l.sessions[t.id] = t
+	l.mu.Unlock()
+}
+
+func (l *LiveSessionIndex) Remove(id string) {
+	l.mu.Lock()
+	delete(l.sessions, id)
+	l.mu.Unlock()
+}
+
+func (l *LiveSessionIndex) Get(id string) (*TerminalSession, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	t, ok := l.sessions[id]
+	return t, ok
+}
+
+// Len returns the number of running sessions
+func (l *LiveSessionIndex) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.sessions)
+}
+
+// All returns all running sessions
+func (l *LiveSessionIndex) All() []*TerminalSession {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	all := make([]*TerminalSession, 0, len(l.sessions))
+	for _, t := range l.sessions {
+		all = append(all, t)
+	}
+	return all
+}
+
+// List returns snapshots of all running sessions ordered by start time
+func (l *LiveSessionIndex) List() []LiveSession {
+	l.mu.RLock()
+	list := make([]LiveSession, 0, len(l.sessions))
+	for _, t := range l.sessions {
+		list = append(list, t.snapshot())
+	}
+	l.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
+	return list
+}
+
+func (t TerminalSession) snapshot() LiveSession {
+	return LiveSession{
+		ID:           t.id,
+		Kind:         t.cInfo.Kind,
+		User:         t.cInfo.Owner,
+		Cluster:      t.cInfo.ClusterName,
+		Namespace:    t.cInfo.Namespace,
+		Pod:          t.cInfo.PodName,
+		Container:    t.cInfo.ContainerName,
+		Node:         t.cInfo.NodeName,
+		StartTime:    t.stats.startTime,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&t.stats.lastActivity)),
+		BytesIn:      atomic.LoadInt64(&t.stats.bytesIn),
+		BytesOut:     atomic.LoadInt64(&t.stats.bytesOut),
+		Watchers:     t.watchers.Len(),
+	}
+}
+
+func handleListSessions(request *restful.Request, response *restful.Response) {
+	_ = response.WriteHeaderAndEntity(http.StatusOK, liveSessions.List())
+}
+
+func handleGetSession(request *restful.Request, response *restful.Response) {
+	t, ok := liveSessions.Get(request.PathParameter("session"))
+	if !ok {
+		errdef.HandleInternalErrorByCode(response, errdef.SessionNotFound)
+		return
+	}
+	_ = response.WriteHeaderAndEntity(http.StatusOK, t.snapshot())
+}
+
+// handleTerminateSession closes a running session, the reason is shown to the user of the session
+func handleTerminateSession(request *restful.Request, response *restful.Response) {
+	t, ok := liveSessions.Get(request.PathParameter("session"))
+	if !ok {
+		errdef.HandleInternalErrorByCode(response, errdef.SessionNotFound)
+		return
+	}
+
+	operator := utils.GetUserFromReq(request)
+	reason := request.QueryParameter("reason")
+	if reason == "" {
+		reason = "session terminated by administrator"
+	}
+	clog.Info("session %v is terminated by %v, reason: %v", t.id, operator, reason)
+
+	t.audit(fmt.Sprintf("terminated by %s: %s", operator, reason), "terminate")
+	_ = t.Toast(reason)
+	t.Close(CloseStatusTerminated, reason)
+
+	_ = response.WriteHeaderAndEntity(http.StatusOK, t.snapshot())
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/emicklei/go-restful"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"kubecube-webconsole/errdef"
+	"kubecube-webconsole/utils"
+)
+
+// handleLogShell issues a session id to stream the log of a container
+func handleLogShell(request *restful.Request, response *restful.Response) {
+	clusterName := request.PathParameter("cluster")
+	if _, err := getNonControlCfg(clusterName); err != nil {
+		clog.Error("fail to fetch rest.config for cluster [%s], msg: %v", clusterName, err)
+		errdef.HandleInternalErrorByCode(response, errdef.ClusterInfoNotFound)
+		return
+	}
+
+	logOptions, errInfo := getLogOptions(request)
+	if errInfo != nil {
+		errdef.HandleInternalErrorByCode(response, *errInfo)
+		return
+	}
+
+	cInfo, errInfo := getConnInfo(request)
+	if errInfo != nil {
+		errdef.HandleInternalErrorByCode(response, *errInfo)
+		return
+	}
+	cInfo.Owner = utils.GetUserFromReq(request)
+	cInfo.Kind = SessionKindLog
+	cInfo.LogOptions = logOptions
+
+	sessionId, err := issueSession(cInfo)
+	if err != nil {
+		clog.Error("generate session id failed. Error msg: " + err.Error())
+		errdef.HandleInternalError(response, err)
+		return
+	}
+	clog.Info("log sessionId: %s", sessionId)
+
+	_ = response.WriteHeaderAndEntity(http.StatusOK, TerminalResponse{Id: sessionId})
+}
+
+func getLogOptions(request *restful.Request) (*v1.PodLogOptions, *errdef.ErrorInfo) {
+	opts := &v1.PodLogOptions{
+		Container: request.PathParameter("container"),
+	}
+	var err error
+	if v := request.QueryParameter("follow"); v != "" {
+		if opts.Follow, err = strconv.ParseBool(v); err != nil {
+			return nil, &errdef.InvalidParameter
+		}
+	}
+	if v := request.QueryParameter("previous"); v != "" {
+		if opts.Previous, err = strconv.ParseBool(v); err != nil {
+			return nil, &errdef.InvalidParameter
+		}
+	}
+	if v := request.QueryParameter("timestamps"); v != "" {
+		if opts.Timestamps, err = strconv.ParseBool(v); err != nil {
+			return nil, &errdef.InvalidParameter
+		}
+	}
+	if v := request.QueryParameter("tailLines"); v != "" {
+		tailLines, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || tailLines < 0 {
+			return nil, &errdef.InvalidParameter
+		}
+		opts.TailLines = &tailLines
+	}
+	if v := request.QueryParameter("sinceSeconds"); v != "" {
+		sinceSeconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sinceSeconds <= 0 {
+			return nil, &errdef.InvalidParameter
+		}
+		opts.SinceSeconds = &sinceSeconds
+	}
+	return opts, nil
+}
+
+// streamContainerLog copies the log of container to the terminal until the log ends or the user leaves
+func streamContainerLog(k8sClient *rest.RESTClient, info *ConnInfo, t TerminalSession) error {
+	opts := info.LogOptions
+	if opts == nil {
+		opts = &v1.PodLogOptions{}
+	}
+	opts.Container = info.ContainerName
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the log is read-only, stop streaming once the user leaves
+	go func() {
+		serveReadOnly(t.conn, "log session is read-only, input is ignored", t.recorder.Resize)
+		cancel()
+	}()
+
+	stream, err := k8sClient.Get().
+		Resource("pods").
+		Name(info.PodName).
+		Namespace(info.Namespace).
+		SubResource("log").
+		VersionedParams(opts, scheme.ParameterCodec).
+		Stream(ctx)
+	if err != nil {
+		clog.Error("open log stream of pod %v failed: %v", info.PodName, err)
+		return err
+	}
+	defer stream.Close()
+
+	_, err = io.Copy(crlfWriter{w: t}, stream)
+	if err != nil && ctx.Err() != nil {
+		// canceled by user
+		return nil
+	}
+	return err
+}
+
+// crlfWriter converts "\n" to "\r\n" as xterm does not do it for us
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -17,14 +17,12 @@ limitations under the License.
 package handler
 
 import (
-	"bytes"
 	"flag"
 	"github.com/patrickmn/go-cache"
-	"gopkg.in/igm/sockjs-go.v2/sockjs"
 	"io"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/remotecommand"
 	"net/http"
-	"sync"
 	"time"
 )
 
@@ -33,10 +31,22 @@ const (
 	LeaderElectionNamespace = "kube-system"
 	NamespaceKey            = "namespace"
 	ClusterKey              = "cluster"
+	NodeKey                 = "node"
+	PortKey                 = "port"
 	KubeCubeChrootShPath    = "/kubecube-chroot.sh"
 	CloudShellLabelKey      = "kubecube.io/app"
 )
 
+// kinds of terminal session
+const (
+	SessionKindExec        = ""
+	SessionKindLog         = "log"
+	SessionKindAttach      = "attach"
+	SessionKindDebug       = "debug"
+	SessionKindNode        = "node"
+	SessionKindPortForward = "portforward"
+)
+
 const (
 	ResourceContainer = "container"
 	IoStdin           = "stdin"
@@ -46,7 +56,7 @@ const (
 )
 
 // TerminalResponse is sent by handleExecShell. The Id is a random session id that binds the original REST request and the SockJS connection.
-// Any clientapi in possession of this Id can hijack the terminal session.
+// The Id can be bound only once, by the same user who requested it and before sessionBindTimeout passed.
 type TerminalResponse struct {
 	Id      string `json:"id,omitempty"`
 	Message string `json:"message,omitempty"`
@@ -61,10 +71,16 @@ type ConnInfo struct {
 	ScriptUser    string `json:"scriptUser"` // the username used by the script in the container
 	ScriptUID     string `json:"scriptUID"`  // the userid used by the script in the container
 	// the user permission level used by the script in the container is customized by the user, such as dev, ops, admin
-	ScriptUserAuth   string        `json:"scriptUserAuth"`
-	IsControlCluster bool          `json:"isControlCluster"`
-	AuditRawInfo     *AuditRawInfo `json:"audit_raw_info,omitempty"`
-	Header           http.Header   `json:"header,omitempty"`
+	ScriptUserAuth   string            `json:"scriptUserAuth"`
+	IsControlCluster bool              `json:"isControlCluster"`
+	AuditRawInfo     *AuditRawInfo     `json:"audit_raw_info,omitempty"`
+	Header           http.Header       `json:"header,omitempty"`
+	Owner            string            `json:"owner,omitempty"`        // the KubeCube user who requested the session
+	WatchSession     string            `json:"watchSession,omitempty"` // the running session to watch in read-only mode
+	Kind             string            `json:"kind,omitempty"`         // what the session connects to, default is SessionKindExec
+	LogOptions       *v1.PodLogOptions `json:"logOptions,omitempty"`
+	NodeName         string            `json:"nodeName,omitempty"`
+	Port             uint16            `json:"port,omitempty"`
 }
 
 type AuditRawInfo struct {
@@ -78,7 +94,26 @@ var (
 	configMap *cache.Cache // store kubeconfig information
 	// store the information needed to connect to the container,
 	// such as cluster name, namespace, pod name, container name, userinfo in the container, etc.
-	connMap sync.Map
+	sessions SessionStore
+	// store the running terminal sessions
+	liveSessions *LiveSessionIndex
+	// store the running watchers and port forwards to close on shutdown
+	drainConns *connRegistry
+	// count sessions against quotas
+	sessionQuotas *sessionQuota
+
+	recordScopeList     scopeList // clusters and namespaces whose sessions are recorded
+	debugScopeList      scopeList // clusters and namespaces where debug containers are allowed
+	portForwardPortList portList  // ports of pods allowed to forward
+
+	sessionIdleTimeoutList scopedDurations // idle timeouts overriding sessionIdleTimeout
+	sessionMaxDurationList scopedDurations // max durations overriding sessionMaxDuration
+
+	defaultShellList shellCandidates      // shells tried in order if no image override matches
+	imageShellList   []imageShellOverride // shell overrides of images
+
+	auditRedactors      []redactor     // mask secrets in audit messages
+	auditRedactPatterns stringListFlag // user defined regexes of auditRedactors
 
 	CloudShellDpName string
 	CloudShellNs     string
@@ -91,18 +126,107 @@ var (
 	appNamespace      = flag.String("appNamespace", "kubecube-system", "namespace of cloud shell deployment, default same as kubecube-system")
 	enableAudit       = flag.Bool("enableAudit", true, "enable audit function")
 	enableStdoutAudit = flag.Bool("enableStdoutAudit", false, "enable stdout audit")
+	auditKeystrokes   = flag.Bool("auditKeystrokes", false, "add the raw keystrokes of each command line to stdin audit messages")
 	auditURL          = flag.String("auditURL", "http://audit.kubecube-system:8888/api/v1/cube/audit/cube", "send audit message to the url")
 	auditMethod       = flag.String("auditMethod", "POST", "send audit message request method")
 	auditHeader       = flag.String("auditHeader", "Content-Type=application/json;charset=UTF-8", "send audit message request header")
+
+	ActiveActive       = flag.Bool("activeActive", false, "every replica is ready and serves sessions, leader election only runs singleton background tasks; use it with --sessionStore=kubernetes. Running sessions, watchers and the admin session api stay per replica")
+	LeaseNamespace     = flag.String("leaderElectionNamespace", LeaderElectionNamespace, "namespace of the Lease of leader election")
+	LeaseDuration      = flag.Duration("leaderElectionLeaseDuration", 15*time.Second, "duration non-leaders wait to take over the Lease")
+	LeaseRenewDeadline = flag.Duration("leaderElectionRenewDeadline", 10*time.Second, "duration the leader retries to renew the Lease before giving up")
+	LeaseRetryPeriod   = flag.Duration("leaderElectionRetryPeriod", 2*time.Second, "interval of leader election clients between tries")
+
+	shutdownDrainPeriod = flag.Duration("shutdownDrainPeriod", 15*time.Second, "on SIGTERM, wait for running sessions to end within the period before closing them; the period, auditFlushTimeout and 10s to close sessions and http requests must fit in terminationGracePeriodSeconds")
+	auditFlushTimeout   = flag.Duration("auditFlushTimeout", 5*time.Second, "on SIGTERM, wait for queued audit messages to be delivered within the timeout")
+
+	sessionBindTimeout = flag.Duration("sessionBindTimeout", 2*time.Minute, "session id expires if it is not bound by SockJS within the timeout")
+	sessionStore       = flag.String("sessionStore", SessionStoreMemory, "store of session ids waiting for bind: memory, or kubernetes to keep them as Secrets in appNamespace of pivot cluster so any replica can bind them")
+
+	sessionIdleTimeout    = flag.Duration("sessionIdleTimeout", 30*time.Minute, "close sessions and port forwards without input or output for the duration, 0 disables it. Watchers end with the watched session")
+	sessionIdleTimeouts   = flag.String("sessionIdleTimeouts", "", "comma separated idle timeouts of clusters or cluster/namespace overriding sessionIdleTimeout, for example 'member1=1h,*/kube-system=10m'")
+	sessionMaxDuration    = flag.Duration("sessionMaxDuration", 0, "close sessions and port forwards lasting for the duration, 0 disables it. Watchers end with the watched session")
+	sessionMaxDurations   = flag.String("sessionMaxDurations", "", "comma separated max durations of clusters or cluster/namespace overriding sessionMaxDuration, for example 'pivot-cluster/kube-system=1h'")
+	sessionTimeoutWarning = flag.Duration("sessionTimeoutWarning", time.Minute, "warn the user by toast the duration before the session is closed by timeout")
+
+	sessionQuotaPerUser      = flag.Int("sessionQuotaPerUser", 0, "max sessions of a user on this replica, 0 is unlimited")
+	sessionQuotaPerCluster   = flag.Int("sessionQuotaPerCluster", 0, "max sessions to a cluster on this replica, 0 is unlimited")
+	sessionQuotaPerNamespace = flag.Int("sessionQuotaPerNamespace", 0, "max sessions to a namespace on this replica, 0 is unlimited")
+	sessionQuotaPerReplica   = flag.Int("sessionQuotaPerReplica", 0, "max sessions on this replica, 0 is unlimited. All session quotas count the sessions bound to this replica and the ones it issued but not bound yet, running file transfers count as sessions. They are not cluster-wide in active-active mode")
+
+	enableRecord = flag.Bool("enableRecord", false, "record terminal sessions in asciicast v2 format")
+	recordDir    = flag.String("recordDir", "/var/lib/webconsole/recordings", "directory to store session recordings, recordings are served only by the replica which wrote them unless it is shared by all replicas")
+	recordScopes = flag.String("recordScopes", "", "comma separated clusters or cluster/namespace to record, for example 'pivot-cluster,member1/default,*/kube-system', empty means all")
+
+	watchReplayBytes = flag.Int("watchReplayBytes", 64*1024, "bytes of recent output replayed to a watcher when it joins")
+
+	enableDebug       = flag.Bool("enableDebug", false, "allow debug sessions which inject ephemeral containers into pods")
+	debugImage        = flag.String("debugImage", "busybox:1.35", "image of the ephemeral container for debug sessions")
+	debugScopes       = flag.String("debugScopes", "", "comma separated clusters or cluster/namespace where debug sessions are allowed, empty means all")
+	debugStartTimeout = flag.Duration("debugStartTimeout", 2*time.Minute, "timeout waiting for the ephemeral container to run")
+
+	enableNodeShell       = flag.Bool("enableNodeShell", false, "allow cluster admins to open shells on nodes through privileged pods")
+	nodeShellImage        = flag.String("nodeShellImage", "busybox:1.35", "image of the privileged pod for node shell, it must contain nsenter")
+	nodeShellNamespace    = flag.String("nodeShellNamespace", "kube-system", "namespace of the privileged pod for node shell in member clusters")
+	nodeShellStartTimeout = flag.Duration("nodeShellStartTimeout", 2*time.Minute, "timeout waiting for the node shell pod to run")
+	nodeShellPodTTL       = flag.Duration("nodeShellPodTTL", 12*time.Hour, "active deadline of the node shell pod in case it is not deleted")
+
+	fileUploadMaxBytes = flag.Int64("fileUploadMaxBytes", 512*1024*1024, "max size of the tar archive uploaded to containers")
+
+	portForwardPorts = flag.String("portForwardPorts", "", "comma separated ports or port ranges of pods allowed to forward, for example '6060,8080-8090', empty disables port-forward")
+
+	shells      = flag.String("shells", "/bin/zsh,/bin/bash,/bin/ash,/bin/sh,/bin/busybox sh", "comma separated shells tried in order, the first one exists in container is used")
+	imageShells = flag.String("imageShells", "", "semicolon separated shells of images overriding --shells, patterns without / match the last path element of the image, for example 'alpine*=/bin/ash,/bin/sh;*/distroless/*=/busybox/sh'")
+
+	commandPolicyConfigMap = flag.String("commandPolicyConfigMap", "", "configmap in appNamespace of pivot cluster with command rules in key rules.yaml, empty disables command policy")
+	commandPolicyResync    = flag.Duration("commandPolicyResync", 30*time.Second, "interval to reload the command policy configmap")
+
+	auditRedactorNames = flag.String("auditRedactors", "password-flags,env-secrets,bearer,jwt,private-key,secret-data", "comma separated builtin redactors masking secrets in audit messages, empty disables them")
+
+	auditSinkNames      = flag.String("auditSinks", "http", "comma separated sinks of audit messages: http, file, syslog, stdout")
+	auditSinkQueueSize  = flag.Int("auditSinkQueueSize", 1000, "messages queued in memory for each audit sink, see auditOverloadPolicy for what happens when it is full")
+	auditFile           = flag.String("auditFile", "/var/log/webconsole/audit.log", "JSON lines file of the file audit sink")
+	auditFileMaxSizeMB  = flag.Int("auditFileMaxSizeMB", 100, "the audit file is rotated when it reaches the size in megabytes")
+	auditFileMaxBackups = flag.Int("auditFileMaxBackups", 5, "rotated audit files to retain, 0 retains all")
+	auditSyslogAddr     = flag.String("auditSyslogAddr", "udp://127.0.0.1:514", "address of the syslog audit sink, for example udp://host:514, tcp://host:601 or tls://host:6514")
+	auditSyslogCA       = flag.String("auditSyslogCA", "", "CA file to verify the syslog server over tls, empty uses system roots")
+
+	auditSpoolDir         = flag.String("auditSpoolDir", "", "directory of the write-ahead log of audit messages, messages are retried until delivered and replayed after restart, empty keeps them in memory")
+	auditSpoolMaxBytes    = flag.Int64("auditSpoolMaxBytes", 1024*1024*1024, "max bytes of the audit spool of each sink, new messages are dropped when it is full")
+	auditSpoolSync        = flag.Bool("auditSpoolSync", true, "fsync the audit spool after each message")
+	auditRetryMinInterval = flag.Duration("auditRetryMinInterval", 80*time.Millisecond, "first interval to retry sending audit message, it grows 2.5 times each retry")
+	auditRetryMaxInterval = flag.Duration("auditRetryMaxInterval", 30*time.Second, "max interval to retry sending audit message")
+
+	auditWorkers        = flag.Int("auditWorkers", 4, "workers sending audit messages of each sink in memory")
+	auditBatchSize      = flag.Int("auditBatchSize", 100, "max audit messages sent in one batch")
+	auditBatchInterval  = flag.Duration("auditBatchInterval", time.Second, "a batch of audit messages is sent when the interval passed even if it is not full")
+	auditBatchURL       = flag.String("auditBatchURL", "", "url of the audit service accepting a JSON array of messages, messages are sent to auditURL one by one if empty")
+	auditOverloadPolicy = flag.String("auditOverloadPolicy", AuditOverloadDropOldest, "policy when the audit queue in memory is full: drop-oldest, block or spill")
+	auditSpillDir       = flag.String("auditSpillDir", "/var/lib/webconsole/audit-spill", "directory of the spool of audit messages overflowed from memory when auditOverloadPolicy is spill")
+
+	webSocketOrigins = flag.String("webSocketOrigins", "", "comma separated origins allowed to open /api/websocket, '*' allows any, empty only allows same origin")
 )
 
-// TerminalSession implements PtyHandler (using a SockJS connection)
+// TerminalConn is the connection between front end and TerminalSession, sockjs.Session implements it
+type TerminalConn interface {
+	Recv() (string, error)
+	Send(string) error
+	Close(status uint32, reason string) error
+}
+
+// TerminalSession implements PtyHandler (using a SockJS or WebSocket connection)
 type TerminalSession struct {
-	id            string
-	sockJSSession sockjs.Session
-	sizeChan      chan remotecommand.TerminalSize
-	stdinBuffer   *bytes.Buffer
-	cInfo         *ConnInfo
+	id       string
+	conn     TerminalConn
+	codec    *frameCodec
+	sizeChan chan remotecommand.TerminalSize
+	editor   *lineEditor // reconstructs command lines from stdin and the echo in stdout
+	cInfo    *ConnInfo
+	recorder *Recorder
+	stats    *sessionStats
+	watchers *watcherHub
+	closer   *sessionCloser
+	stdout   *redactStream // masks secrets split across stdout audit messages
 }
 
 // TerminalMessage is the messaging protocol between ShellController and TerminalSession.
@@ -114,9 +238,15 @@ type TerminalSession struct {
 // resize  fe->be     Rows, Cols     New terminal size
 // stdout  be->fe     Data           Output from the process
 // toast   be->fe     Data           OOB message to be shown to the user
+// shell   be->fe     Data           Shell run by the session
+//
+// The bind message also carries the Token of the user who requested the Id,
+// and the Encoding of stdin and stdout Data the client accepts, see EncodingText.
 type TerminalMessage struct {
 	Op, Data, SessionID string
 	Rows, Cols          uint16
+	Token               string `json:",omitempty"`
+	Encoding            string `json:",omitempty"`
 }
 
 // PtyHandler is what remotecommand expects from a pty
@@ -128,16 +258,18 @@ type PtyHandler interface {
 
 // AuditMsg stores info sent to audit server
 type AuditMsg struct {
-	SessionID     string    `json:"session_id"`
-	CreateTime    time.Time `json:"create_time"`
-	PodName       string    `json:"pod_name,omitempty"`
-	Namespace     string    `json:"namespace,omitempty"`
-	ClusterName   string    `json:"cluster_name,omitempty"`
-	Data          string    `json:"data"`
-	DataType      string    `json:"data_type"` //stdin, stdout
-	RemoteIP      string    `json:"remote_ip,omitempty"`
-	UserAgent     string    `json:"user_agent,omitempty"`
-	ContainerUser string    `json:"container_user,omitempty"`
-	WebUser       string    `json:"web_user,omitempty"`
-	Platform      string    `json:"platform,omitempty"` // 通过什么平台传入的，如严选SNest\严选Opera或者轻舟页面
+	SessionID     string        `json:"session_id"`
+	CreateTime    time.Time     `json:"create_time"`
+	PodName       string        `json:"pod_name,omitempty"`
+	Namespace     string        `json:"namespace,omitempty"`
+	ClusterName   string        `json:"cluster_name,omitempty"`
+	Data          string        `json:"data"`
+	Keystrokes    string        `json:"keystrokes,omitempty"` // raw keystrokes of the stdin command line, see auditKeystrokes
+	DataType      string        `json:"data_type"`            //stdin, stdout, terminate, watch, debug, node, download, upload, portforward, deny, session_*, shell_selected
+	RemoteIP      string        `json:"remote_ip,omitempty"`
+	UserAgent     string        `json:"user_agent,omitempty"`
+	ContainerUser string        `json:"container_user,omitempty"`
+	WebUser       string        `json:"web_user,omitempty"`
+	Platform      string        `json:"platform,omitempty"` // 通过什么平台传入的，如严选SNest\严选Opera或者轻舟页面
+	Event         *SessionEvent `json:"event,omitempty"`    // detail of session lifecycle data types
 }
@@ -0,0 +1,66 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "webconsole"
+
+// results of audit messages
+const (
+	auditResultDelivered = "delivered"
+	auditResultFailed    = "failed"
+	auditResultDropped   = "dropped"
+	auditResultSpilled   = "spilled"
+	auditResultBlocked   = "blocked"
+)
+
+var (
+	auditMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "audit",
+		Name:      "messages_total",
+		Help:      "Audit messages by sink and result, result is one of delivered, failed, dropped, spilled and blocked.",
+	}, []string{"sink", "result"})
+
+	auditBatchSizes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "audit",
+		Name:      "batch_size",
+		Help:      "Audit messages delivered in one batch by sink.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50, 100, 200, 500},
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(auditMessages, auditBatchSizes)
+}
+
+// registerAuditQueueDepth exports the backlog of the audit queue of sink
+func registerAuditQueueDepth(sink string, q auditQueue) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Subsystem:   "audit",
+		Name:        "queue_depth",
+		Help:        "Audit messages not delivered yet by sink.",
+		ConstLabels: prometheus.Labels{"sink": sink},
+	}, func() float64 {
+		return float64(q.Depth())
+	}))
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"kubecube-webconsole/errdef"
+	"kubecube-webconsole/utils"
+)
+
+const (
+	nodeShellPodPrefix     = "node-shell-"
+	nodeShellContainerName = "shell"
+	nodeShellLabelValue    = "kubecube-node-shell"
+)
+
+// enter all namespaces of the init process of node except pid
+var nodeShellCmds = []string{"nsenter", "-t", "1", "-m", "-u", "-i", "-n"}
+
+// NodeAuthorityVerify only allows users who can update nodes of the cluster,
+// which is stricter than PodAuthorityVerify as node shell is root on the node
+func NodeAuthorityVerify(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	user := utils.GetUserFromReq(request)
+	if user == "" {
+		clog.Error("the user is not exists")
+		_ = response.WriteHeaderAndEntity(http.StatusUnauthorized, TerminalResponse{Message: "permission denied"})
+		return
+	}
+	if !isAccessAllowed(&attributes{
+		User:            user,
+		Verb:            "update",
+		Resource:        "nodes",
+		Name:            request.PathParameter(NodeKey),
+		ResourceRequest: true,
+		Cluster:         request.PathParameter(ClusterKey),
+	}) {
+		clog.Info("user %v has no permission to update node %v", user, request.PathParameter(NodeKey))
+		_ = response.WriteHeaderAndEntity(http.StatusForbidden, TerminalResponse{Message: "permission denied"})
+		return
+	}
+	chain.ProcessFilter(request, response)
+}
+
+// handleNodeShell issues a session id to open a shell on the node
+func handleNodeShell(request *restful.Request, response *restful.Response) {
+	if !*enableNodeShell {
+		errdef.HandleInternalErrorByCode(response, errdef.NodeShellNotAllowed)
+		return
+	}
+
+	clusterName := request.PathParameter(ClusterKey)
+	if _, err := getNonControlCfg(clusterName); err != nil {
+		clog.Error("fail to fetch rest.config for cluster [%s], msg: %v", clusterName, err)
+		errdef.HandleInternalErrorByCode(response, errdef.ClusterInfoNotFound)
+		return
+	}
+
+	cInfo, errInfo := getConnInfo(request)
+	if errInfo != nil {
+		errdef.HandleInternalErrorByCode(response, *errInfo)
+		return
+	}
+	cInfo.Namespace = *nodeShellNamespace
+	cInfo.ContainerName = nodeShellContainerName
+	cInfo.NodeName = request.PathParameter(NodeKey)
+	cInfo.Owner = utils.GetUserFromReq(request)
+	cInfo.Kind = SessionKindNode
+
+	sessionId, err := issueSession(cInfo)
+	if err != nil {
+		clog.Error("generate session id failed. Error msg: " + err.Error())
+		errdef.HandleInternalError(response, err)
+		return
+	}
+	clog.Info("node shell sessionId: %s, node: %s", sessionId, cInfo.NodeName)
+
+	_ = response.WriteHeaderAndEntity(http.StatusOK, TerminalResponse{Id: sessionId})
+}
+
+// nodeShell runs a privileged pod on the node and enters the namespaces of the node
+// through it, the pod is deleted when the session ends
+func nodeShell(k8sClient *rest.RESTClient, cfg *rest.Config, info *ConnInfo, t TerminalSession) error {
+	ctx := context.Background()
+
+	pod := newNodeShellPod(info)
+	err := k8sClient.Post().
+		Resource("pods").
+		Namespace(info.Namespace).
+		Body(pod).
+		Do(ctx).
+		Into(pod)
+	if err != nil {
+		clog.Error("create node shell pod on node %v failed: %v", info.NodeName, err)
+		return err
+	}
+	info.PodName = pod.Name
+	clog.Info("node shell pod %v/%v is created on node %v", pod.Namespace, pod.Name, info.NodeName)
+	t.audit(fmt.Sprintf("create node shell pod %s on node %s", pod.Name, info.NodeName), "node")
+
+	defer func() {
+		err := k8sClient.Delete().
+			Resource("pods").
+			Name(pod.Name).
+			Namespace(pod.Namespace).
+			Body(metav1.NewDeleteOptions(0)).
+			Do(context.Background()).
+			Error()
+		if err != nil {
+			clog.Error("delete node shell pod %v/%v failed: %v", pod.Namespace, pod.Name, err)
+			return
+		}
+		clog.Info("node shell pod %v/%v is deleted", pod.Namespace, pod.Name)
+	}()
+
+	_ = t.Toast(fmt.Sprintf("Waiting for node shell pod on %s to start...", info.NodeName))
+	if err = waitForPodRunning(ctx, k8sClient, pod.Namespace, pod.Name); err != nil {
+		clog.Error("wait for node shell pod %v failed: %v", pod.Name, err)
+		return err
+	}
+
+	req := k8sClient.Post().
+		Resource("pods").
+		Name(pod.Name).
+		Namespace(pod.Namespace).
+		SubResource("exec")
+	req = req.VersionedParams(&v1.PodExecOptions{
+		Command:   nodeShellCmds,
+		Container: nodeShellContainerName,
+		Stdin:     true,
+		Stdout:    true,
+		Stderr:    true,
+		TTY:       true,
+	}, scheme.ParameterCodec)
+
+	return postReq(req, cfg, t)
+}
+
+func newNodeShellPod(info *ConnInfo) *v1.Pod {
+	privileged := true
+	gracePeriod := int64(0)
+	// the pod is deleted when session ends, deadline only protects from leaking pods
+	deadline := int64(nodeShellPodTTL.Seconds())
+
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: nodeShellPodPrefix,
+			Namespace:    info.Namespace,
+			Labels: map[string]string{
+				CloudShellLabelKey: nodeShellLabelValue,
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName:                      info.NodeName,
+			HostPID:                       true,
+			HostNetwork:                   true,
+			HostIPC:                       true,
+			RestartPolicy:                 v1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: &gracePeriod,
+			ActiveDeadlineSeconds:         &deadline,
+			Tolerations: []v1.Toleration{
+				{Operator: v1.TolerationOpExists},
+			},
+			Containers: []v1.Container{
+				{
+					Name:            nodeShellContainerName,
+					Image:           *nodeShellImage,
+					ImagePullPolicy: v1.PullIfNotPresent,
+					Command:         []string{"sleep", strconv.FormatInt(deadline, 10)},
+					SecurityContext: &v1.SecurityContext{
+						Privileged: &privileged,
+					},
+				},
+			},
+		},
+	}
+}
+
+func waitForPodRunning(ctx context.Context, k8sClient *rest.RESTClient, namespace, name string) error {
+	return wait.PollImmediate(time.Second, *nodeShellStartTimeout, func() (bool, error) {
+		pod := v1.Pod{}
+		err := k8sClient.Get().
+			Resource("pods").
+			Name(name).
+			Namespace(namespace).
+			Do(ctx).
+			Into(&pod)
+		if err != nil {
+			return false, err
+		}
+		switch pod.Status.Phase {
+		case v1.PodRunning:
+			return true, nil
+		case v1.PodFailed, v1.PodSucceeded:
+			return false, fmt.Errorf("pod %s exited with phase %s", name, pod.Status.Phase)
+		}
+		return false, nil
+	})
+}
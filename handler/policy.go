@@ -0,0 +1,247 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kubecube-io/kubecube/pkg/clients"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	"github.com/kubecube-io/kubecube/pkg/utils/constants"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// actions of command rules
+const (
+	CommandActionAllow = "allow"
+	CommandActionWarn  = "warn"
+	CommandActionDeny  = "deny"
+)
+
+// commandPolicyKey is the key of rules in the ConfigMap
+const commandPolicyKey = "rules.yaml"
+
+// killLine is sent to the container instead of a denied command, it clears
+// what the shell has echoed so far (Ctrl-U)
+const killLine = "\x15"
+
+// CommandRule matches a command by Regex or Glob, for sessions in Scopes of Users.
+// Scopes are "cluster" or "cluster/namespace" with "*" as wildcard, empty Scopes or Users match all.
+type CommandRule struct {
+	Name    string   `json:"name"`
+	Action  string   `json:"action"`
+	Regex   string   `json:"regex,omitempty"`
+	Glob    string   `json:"glob,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+	Users   []string `json:"users,omitempty"`
+	Message string   `json:"message,omitempty"`
+
+	pattern *regexp.Regexp
+	scopes  scopeList
+}
+
+// CommandPolicy is loaded from the ConfigMap. A command matching any allow rule is allowed,
+// otherwise it is denied if it matches any deny rule, or warned if it matches any warn rule.
+type CommandPolicy struct {
+	Rules []*CommandRule `json:"rules"`
+}
+
+// commandPolicy stores the current *CommandPolicy
+var commandPolicy atomic.Value
+
+func parseCommandPolicy(data string) (*CommandPolicy, error) {
+	policy := &CommandPolicy{}
+	if strings.TrimSpace(data) == "" {
+		return policy, nil
+	}
+	if err := yaml.NewYAMLOrJSONDecoder(strings.NewReader(data), 4096).Decode(policy); err != nil {
+		return nil, err
+	}
+	for i, rule := range policy.Rules {
+		switch rule.Action {
+		case CommandActionAllow, CommandActionWarn, CommandActionDeny:
+		default:
+			return nil, fmt.Errorf("rule %d %s: unknown action %q", i, rule.Name, rule.Action)
+		}
+		expr := rule.Regex
+		if rule.Glob != "" {
+			if expr != "" {
+				return nil, fmt.Errorf("rule %d %s: only one of regex and glob can be set", i, rule.Name)
+			}
+			expr = globToRegexp(rule.Glob)
+		}
+		if expr == "" {
+			return nil, fmt.Errorf("rule %d %s: regex or glob is required", i, rule.Name)
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d %s: %v", i, rule.Name, err)
+		}
+		rule.pattern = pattern
+		rule.scopes = parseScopeList(strings.Join(rule.Scopes, ","))
+	}
+	return policy, nil
+}
+
+// globToRegexp converts a glob to an anchored regexp, "*" matches any characters
+// including "/" as commands are not paths
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func (r *CommandRule) match(cluster, namespace, user, cmd string) bool {
+	if !r.scopes.Match(cluster, namespace) {
+		return false
+	}
+	if len(r.Users) > 0 {
+		found := false
+		for _, u := range r.Users {
+			if u == scopeWildcard || u == user {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.pattern.MatchString(cmd)
+}
+
+// Evaluate returns the rule deciding the command, nil means no rule matches
+func (p *CommandPolicy) Evaluate(cluster, namespace, user, cmd string) *CommandRule {
+	if p == nil {
+		return nil
+	}
+	cmd = strings.TrimSpace(cmd)
+	var deny, warn *CommandRule
+	for _, rule := range p.Rules {
+		if !rule.match(cluster, namespace, user, cmd) {
+			continue
+		}
+		switch rule.Action {
+		case CommandActionAllow:
+			return rule
+		case CommandActionDeny:
+			if deny == nil {
+				deny = rule
+			}
+		case CommandActionWarn:
+			if warn == nil {
+				warn = rule
+			}
+		}
+	}
+	if deny != nil {
+		return deny
+	}
+	return warn
+}
+
+// lineVerdict is the rule deciding a submitted line, nil if no rule matches
+type lineVerdict struct {
+	line editedLine
+	rule *CommandRule
+}
+
+// filterLines evaluates the lines submitted in a chunk of stdin data, of which consumed bytes
+// were read by the line editor. It returns the verdicts of lines with a command up to the first
+// denied one, and what is sent to the container: the data before the denied line and killLine,
+// or the consumed data if nothing is denied.
+func (p *CommandPolicy) filterLines(cluster, namespace, user string, data string, lines []editedLine, consumed int) ([]lineVerdict, string) {
+	var verdicts []lineVerdict
+	for _, line := range lines {
+		// if no command in line, no need to check and send
+		if strings.TrimSpace(line.Command) == "" {
+			continue
+		}
+		rule := p.Evaluate(cluster, namespace, user, line.Command)
+		verdicts = append(verdicts, lineVerdict{line: line, rule: rule})
+		if rule != nil && rule.Action == CommandActionDeny {
+			// lines before are sent, the carriage return of the denied line never reaches the container
+			return verdicts, data[:line.Start] + killLine
+		}
+	}
+	return verdicts, data[:consumed]
+}
+
+// reason is shown to the user in toast
+func (r *CommandRule) reason() string {
+	if r.Message != "" {
+		return r.Message
+	}
+	return fmt.Sprintf("matched command rule %s", r.Name)
+}
+
+func currentCommandPolicy() *CommandPolicy {
+	policy, _ := commandPolicy.Load().(*CommandPolicy)
+	return policy
+}
+
+// commandPolicyLoader reloads the policy once the ConfigMap changes
+type commandPolicyLoader struct {
+	resourceVersion string
+}
+
+func (l *commandPolicyLoader) Reload() {
+	cm, err := clients.Interface().Kubernetes(constants.LocalCluster).ClientSet().CoreV1().
+		ConfigMaps(*appNamespace).Get(context.Background(), *commandPolicyConfigMap, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		if l.resourceVersion != "" {
+			clog.Warn("command policy configmap %v/%v is deleted, rules are cleared", *appNamespace, *commandPolicyConfigMap)
+			commandPolicy.Store(&CommandPolicy{})
+			l.resourceVersion = ""
+		}
+		return
+	}
+	if err != nil {
+		clog.Error("get command policy configmap %v/%v failed: %v", *appNamespace, *commandPolicyConfigMap, err)
+		return
+	}
+	if cm.ResourceVersion == l.resourceVersion {
+		return
+	}
+
+	policy, err := parseCommandPolicy(cm.Data[commandPolicyKey])
+	if err != nil {
+		// keep the previous rules
+		clog.Error("parse command policy of configmap %v/%v failed: %v", *appNamespace, *commandPolicyConfigMap, err)
+	} else {
+		commandPolicy.Store(policy)
+		clog.Info("command policy reloaded, %d rules, resource version %v", len(policy.Rules), cm.ResourceVersion)
+	}
+	l.resourceVersion = cm.ResourceVersion
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPolicyRules = `
+rules:
+  - name: allow-rm-tmp
+    action: allow
+    glob: "rm -rf /tmp/*"
+  - name: no-rm-rf
+    action: deny
+    regex: "^rm\\s+-rf\\s"
+    message: rm -rf is not allowed
+  - name: warn-rm
+    action: warn
+    glob: "rm *"
+  - name: no-shutdown-in-prod
+    action: deny
+    glob: "shutdown*"
+    scopes: ["prod", "*/kube-system"]
+  - name: no-reboot-for-guest
+    action: deny
+    glob: "reboot"
+    users: ["guest"]
+`
+
+func TestParseCommandPolicy(t *testing.T) {
+	policy, err := parseCommandPolicy(testPolicyRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 5 {
+		t.Fatalf("got %d rules, want 5", len(policy.Rules))
+	}
+
+	policy, err = parseCommandPolicy("  \n")
+	if err != nil || len(policy.Rules) != 0 {
+		t.Fatalf("got %v and error %v for empty rules", policy, err)
+	}
+
+	invalid := map[string]string{
+		"unknown action": `{"rules": [{"name": "a", "action": "drop", "glob": "ls"}]}`,
+		"regex and glob": `{"rules": [{"name": "a", "action": "deny", "glob": "ls", "regex": "ls"}]}`,
+		"no pattern":     `{"rules": [{"name": "a", "action": "deny"}]}`,
+		"invalid regex":  `{"rules": [{"name": "a", "action": "deny", "regex": "("}]}`,
+		"invalid yaml":   "rules: [",
+	}
+	for name, data := range invalid {
+		if _, err = parseCommandPolicy(data); err == nil {
+			t.Errorf("%s: parsed without error", name)
+		}
+	}
+}
+
+func TestCommandPolicyEvaluate(t *testing.T) {
+	policy, err := parseCommandPolicy(testPolicyRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cluster, namespace, user, cmd string
+		want                          string // name of the rule, empty if no rule matches
+	}{
+		{"dev", "default", "admin", "ls -l", ""},
+		{"dev", "default", "admin", "rm -rf /", "no-rm-rf"},
+		{"dev", "default", "admin", "  rm -rf /var  ", "no-rm-rf"},
+		{"dev", "default", "admin", "rm -rf /tmp/cache", "allow-rm-tmp"},
+		{"dev", "default", "admin", "rm a.txt", "warn-rm"},
+		{"dev", "default", "admin", "shutdown -h now", ""},
+		{"prod", "default", "admin", "shutdown -h now", "no-shutdown-in-prod"},
+		{"dev", "kube-system", "admin", "shutdown", "no-shutdown-in-prod"},
+		{"dev", "default", "admin", "reboot", ""},
+		{"dev", "default", "guest", "reboot", "no-reboot-for-guest"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule := policy.Evaluate(tt.cluster, tt.namespace, tt.user, tt.cmd); rule != nil {
+			got = rule.Name
+		}
+		if got != tt.want {
+			t.Errorf("%v/%v %v %q: got rule %q, want %q", tt.cluster, tt.namespace, tt.user, tt.cmd, got, tt.want)
+		}
+	}
+
+	var none *CommandPolicy
+	if rule := none.Evaluate("dev", "default", "admin", "rm -rf /"); rule != nil {
+		t.Fatalf("got rule %v without policy", rule.Name)
+	}
+}
+
+func TestCommandPolicyFilterLines(t *testing.T) {
+	policy, err := parseCommandPolicy(testPolicyRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		data        string
+		wantForward string
+		wantRules   []string // rules of the verdicts, "-" if no rule matches
+	}{
+		{
+			name:        "allowed",
+			data:        "cd /\rls\r",
+			wantForward: "cd /\rls\r",
+			wantRules:   []string{"-", "-"},
+		},
+		{
+			name:        "denied line is cut",
+			data:        "cd /\rrm -rf /\rls\r",
+			wantForward: "cd /\r" + killLine,
+			wantRules:   []string{"-", "no-rm-rf"},
+		},
+		{
+			name:        "denied first line",
+			data:        "rm -rf /\r",
+			wantForward: killLine,
+			wantRules:   []string{"no-rm-rf"},
+		},
+		{
+			name:        "warned line is sent",
+			data:        "rm a.txt\r",
+			wantForward: "rm a.txt\r",
+			wantRules:   []string{"warn-rm"},
+		},
+		{
+			name:        "empty lines are skipped",
+			data:        "\r \rls",
+			wantForward: "\r \rls",
+			wantRules:   nil,
+		},
+		{
+			name:        "enter of uncertain line is held",
+			data:        "rm -rf /t\t\r",
+			wantForward: "rm -rf /t\t",
+			wantRules:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newLineEditor()
+			lines, n := e.Input(tt.data)
+			verdicts, forward := policy.filterLines("dev", "default", "admin", tt.data, lines, n)
+			if forward != tt.wantForward {
+				t.Fatalf("got forward %q, want %q", forward, tt.wantForward)
+			}
+			var rules []string
+			for _, v := range verdicts {
+				if v.rule == nil {
+					rules = append(rules, "-")
+				} else {
+					rules = append(rules, v.rule.Name)
+				}
+			}
+			if strings.Join(rules, ",") != strings.Join(tt.wantRules, ",") {
+				t.Fatalf("got rules %v, want %v", rules, tt.wantRules)
+			}
+		})
+	}
+}
+
+// the command is evaluated after editing, not on the raw keystrokes
+func TestCommandPolicyFilterEditedLines(t *testing.T) {
+	policy, err := parseCommandPolicy(testPolicyRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"rm -rf ~\x7f/\r", "rm -rf\x1b[D\x1b[D\x1b[D\x1b[D\x1b[D\x1b[C\x1b[C\x1b[C\x1b[C\x1b[C /\r"} {
+		e := newLineEditor()
+		lines, n := e.Input(data)
+		verdicts, forward := policy.filterLines("dev", "default", "admin", data, lines, n)
+		if len(verdicts) != 1 || verdicts[0].rule == nil || verdicts[0].rule.Name != "no-rm-rf" || forward != killLine {
+			t.Fatalf("%q: got verdicts %+v, forward %q", data, verdicts, forward)
+		}
+	}
+
+	data := "rm -rf /\x15ls\r"
+	e := newLineEditor()
+	lines, n := e.Input(data)
+	verdicts, forward := policy.filterLines("dev", "default", "admin", data, lines, n)
+	if len(verdicts) != 1 || verdicts[0].rule != nil || forward != data {
+		t.Fatalf("%q: got verdicts %+v, forward %q", data, verdicts, forward)
+	}
+}
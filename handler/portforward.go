@@ -0,0 +1,259 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/emicklei/go-restful"
+	"github.com/gorilla/websocket"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/transport/spdy"
+	"kubecube-webconsole/errdef"
+	"kubecube-webconsole/utils"
+)
+
+// portForwardProtocolV1Name is the subprotocol of the portforward subresource, the same as kubectl
+const portForwardProtocolV1Name = "portforward.k8s.io"
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	From uint16
+	To   uint16
+}
+
+// portList is parsed from flags like "6060,8080-8090"
+type portList []portRange
+
+func parsePortList(s string) (portList, error) {
+	var list portList
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		from, to := item, item
+		if idx := strings.Index(item, "-"); idx >= 0 {
+			from, to = item[:idx], item[idx+1:]
+		}
+		f, err := parsePort(from)
+		if err != nil {
+			return nil, err
+		}
+		t, err := parsePort(to)
+		if err != nil {
+			return nil, err
+		}
+		if f > t {
+			return nil, fmt.Errorf("invalid port range %s", item)
+		}
+		list = append(list, portRange{From: f, To: t})
+	}
+	return list, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %s", s)
+	}
+	return uint16(port), nil
+}
+
+// Allow returns true if port is in any range of list, an empty list allows nothing
+func (l portList) Allow(port uint16) bool {
+	for _, r := range l {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePortForward issues a session id to forward a port of the pod
+func handlePortForward(request *restful.Request, response *restful.Response) {
+	port, err := parsePort(request.PathParameter(PortKey))
+	if err != nil {
+		errdef.HandleInternalErrorByCode(response, errdef.InvalidParameter)
+		return
+	}
+	if !portForwardPortList.Allow(port) {
+		errdef.HandleInternalErrorByCode(response, errdef.PortForwardNotAllowed)
+		return
+	}
+
+	clusterName := request.PathParameter(ClusterKey)
+	if _, err := getNonControlCfg(clusterName); err != nil {
+		clog.Error("fail to fetch rest.config for cluster [%s], msg: %v", clusterName, err)
+		errdef.HandleInternalErrorByCode(response, errdef.ClusterInfoNotFound)
+		return
+	}
+
+	cInfo, errInfo := getConnInfo(request)
+	if errInfo != nil {
+		errdef.HandleInternalErrorByCode(response, *errInfo)
+		return
+	}
+	cInfo.Owner = utils.GetUserFromReq(request)
+	cInfo.Kind = SessionKindPortForward
+	cInfo.Port = port
+
+	sessionId, err := issueSession(cInfo)
+	if err != nil {
+		clog.Error("generate session id failed. Error msg: " + err.Error())
+		errdef.HandleInternalError(response, err)
+		return
+	}
+	clog.Info("port-forward sessionId: %s, port: %d", sessionId, port)
+
+	_ = response.WriteHeaderAndEntity(http.StatusOK, TerminalResponse{Id: sessionId})
+}
+
+// handlePortForwardSession relays one TCP stream to the port of pod, after the bind message
+// each binary frame of the websocket carries raw bytes of the stream.
+// SockJS can not carry binary frames, so only /api/websocket is supported.
+func handlePortForwardSession(conn TerminalConn, id string, info *ConnInfo) {
+	stats := newSessionStats()
+	forward := drainConns.Add(id, conn, false)
+	defer drainConns.Remove(id)
+
+	done := make(chan struct{})
+	defer close(done)
+	go enforceTimeouts(forward, id, info, stats, done)
+
+	err := forwardPort(conn, id, info, stats)
+	if err != nil {
+		clog.Error("[%v] forward port %d failed: %v", id, info.Port, err)
+		forward.Close(CloseStatusError, err.Error())
+	} else {
+		forward.Close(CloseStatusExited, "connection closed")
+	}
+	auditSessionClosed(id, info, stats, forward.closer.status, forward.closer.reason, err)
+}
+
+// forwardPort relays the stream until either side closes it
+func forwardPort(conn TerminalConn, id string, info *ConnInfo, stats *sessionStats) error {
+	wsConn, ok := conn.(*webSocketConn)
+	if !ok {
+		return errors.New("port-forward is only supported by /api/websocket")
+	}
+
+	k8sClient, cfg, err := getConfigs(info)
+	if err != nil {
+		clog.Error("get rest client failed. Error msg: " + err.Error())
+		return err
+	}
+
+	req := k8sClient.Post().
+		Resource("pods").
+		Name(info.PodName).
+		Namespace(info.Namespace).
+		SubResource("portforward")
+	transport, upgrader, err := spdy.RoundTripperFor(cfg)
+	if err != nil {
+		return err
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", req.URL())
+	streamConn, _, err := dialer.Dial(portForwardProtocolV1Name)
+	if err != nil {
+		clog.Error("dial portforward of pod %v/%v failed: %v", info.Namespace, info.PodName, err)
+		return err
+	}
+	defer streamConn.Close()
+
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, strconv.Itoa(int(info.Port)))
+	headers.Set(v1.PortForwardRequestIDHeader, "0")
+	errorStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return err
+	}
+	// we don't write to the error stream
+	_ = errorStream.Close()
+
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+	dataStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return err
+	}
+
+	clog.Info("[%v] forward port %d of pod %v/%v", id, info.Port, info.Namespace, info.PodName)
+	publishAudit(newAuditMsg(id, info, fmt.Sprintf("forward port %d", info.Port), "portforward"))
+
+	errCh := make(chan error, 3)
+	go func() {
+		message, err := ioutil.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errCh <- fmt.Errorf("read error stream of port %d: %v", info.Port, err)
+		case len(message) > 0:
+			errCh <- fmt.Errorf("forward port %d: %s", info.Port, message)
+		}
+	}()
+
+	go func() {
+		// remote to client
+		_, err := io.Copy(&binaryWriter{conn: wsConn, stats: stats}, dataStream)
+		errCh <- err
+	}()
+	go func() {
+		// client to remote, text frames are ignored
+		for {
+			msgType, data, err := wsConn.conn.ReadMessage()
+			if err != nil {
+				errCh <- nil
+				return
+			}
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+			stats.addIn(len(data))
+			if _, err = dataStream.Write(data); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	err = <-errCh
+	_ = dataStream.Close()
+	publishAudit(newAuditMsg(id, info, fmt.Sprintf("forward port %d finished, %d bytes in, %d bytes out", info.Port, atomic.LoadInt64(&stats.bytesIn), atomic.LoadInt64(&stats.bytesOut)), "portforward"))
+	return err
+}
+
+// binaryWriter sends each write as a binary frame
+type binaryWriter struct {
+	conn  *webSocketConn
+	stats *sessionStats
+}
+
+func (w *binaryWriter) Write(p []byte) (int, error) {
+	if err := w.conn.SendBinary(p); err != nil {
+		return 0, err
+	}
+	w.stats.addOut(len(p))
+	return len(p), nil
+}
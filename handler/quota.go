@@ -0,0 +1,170 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"sync"
+
+	"kubecube-webconsole/errdef"
+)
+
+// quotas of sessions
+const (
+	QuotaUser      = "user"
+	QuotaCluster   = "cluster"
+	QuotaNamespace = "namespace"
+	QuotaReplica   = "replica"
+)
+
+// sessionQuota counts the bound sessions of this replica by user, cluster and namespace.
+// Watchers do not count as they do not connect to the member cluster.
+type sessionQuota struct {
+	mu         sync.Mutex
+	users      map[string]int
+	clusters   map[string]int
+	namespaces map[string]int
+	total      int
+}
+
+func newSessionQuota() *sessionQuota {
+	return &sessionQuota{
+		users:      make(map[string]int),
+		clusters:   make(map[string]int),
+		namespaces: make(map[string]int),
+	}
+}
+
+// quotaUser returns the user the session counts for
+func quotaUser(info *ConnInfo) string {
+	if info.Owner == "" && info.AuditRawInfo != nil {
+		return info.AuditRawInfo.WebUser
+	}
+	return info.Owner
+}
+
+func quotaNamespace(info *ConnInfo) string {
+	return info.ClusterName + "/" + info.Namespace
+}
+
+func countsForQuota(info *ConnInfo) bool {
+	return info.WatchSession == ""
+}
+
+// quotaLimit is a quota the session takes
+type quotaLimit struct {
+	quota string
+	limit int
+	used  int
+	match func(*ConnInfo) bool // matches sessions taking the same quota
+}
+
+// limits returns the quotas info takes with bound sessions as used, q.mu must be held.
+// Sessions of unknown users do not take the quota per user, they would share one.
+func (q *sessionQuota) limits(info *ConnInfo) []quotaLimit {
+	userLimit := *sessionQuotaPerUser
+	if quotaUser(info) == "" {
+		userLimit = 0
+	}
+	return []quotaLimit{
+		{QuotaUser, userLimit, q.users[quotaUser(info)], func(other *ConnInfo) bool {
+			return quotaUser(other) == quotaUser(info)
+		}},
+		{QuotaCluster, *sessionQuotaPerCluster, q.clusters[info.ClusterName], func(other *ConnInfo) bool {
+			return other.ClusterName == info.ClusterName
+		}},
+		{QuotaNamespace, *sessionQuotaPerNamespace, q.namespaces[quotaNamespace(info)], func(other *ConnInfo) bool {
+			return quotaNamespace(other) == quotaNamespace(info)
+		}},
+		{QuotaReplica, *sessionQuotaPerReplica, q.total, func(*ConnInfo) bool {
+			return true
+		}},
+	}
+}
+
+// exceeded returns the error of the first quota used up
+func exceeded(limits []quotaLimit) *errdef.ErrorInfo {
+	for _, l := range limits {
+		if l.limit > 0 && l.used >= l.limit {
+			errInfo := errdef.SessionQuotaExceeded(l.quota, l.used, l.limit)
+			return &errInfo
+		}
+	}
+	return nil
+}
+
+// Check is called before a session id is issued, sessions issued by this replica and not bound yet count as used.
+// Check and issuing the session are not atomic, concurrent requests may all pass and issue a few sessions
+// over the limit, the limit is enforced strictly by Acquire when they are bound.
+func (q *sessionQuota) Check(info *ConnInfo) *errdef.ErrorInfo {
+	if !countsForQuota(info) {
+		return nil
+	}
+	q.mu.Lock()
+	limits := q.limits(info)
+	q.mu.Unlock()
+
+	// the store is walked once for all quotas, it may be remote but only lists sessions of this replica
+	sessions.Pending(func(other *ConnInfo) bool {
+		if countsForQuota(other) {
+			for i := range limits {
+				if limits[i].match(other) {
+					limits[i].used++
+				}
+			}
+		}
+		return false
+	})
+	return exceeded(limits)
+}
+
+// Acquire takes the quota of a session being bound, it must be released once the session ends
+func (q *sessionQuota) Acquire(info *ConnInfo) *errdef.ErrorInfo {
+	if !countsForQuota(info) {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if errInfo := exceeded(q.limits(info)); errInfo != nil {
+		return errInfo
+	}
+	q.add(info, 1)
+	return nil
+}
+
+func (q *sessionQuota) Release(info *ConnInfo) {
+	if !countsForQuota(info) {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(info, -1)
+}
+
+func (q *sessionQuota) add(info *ConnInfo, n int) {
+	inc := func(m map[string]int, key string) {
+		m[key] += n
+		if m[key] <= 0 {
+			delete(m, key)
+		}
+	}
+	if user := quotaUser(info); user != "" {
+		inc(q.users, user)
+	}
+	inc(q.clusters, info.ClusterName)
+	inc(q.namespaces, quotaNamespace(info))
+	q.total += n
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setQuotas sets the quota flags and an empty memory session store until the test ends
+func setQuotas(t *testing.T, user, cluster, namespace, replica int) {
+	flags := []*int{sessionQuotaPerUser, sessionQuotaPerCluster, sessionQuotaPerNamespace, sessionQuotaPerReplica}
+	for i, value := range []int{user, cluster, namespace, replica} {
+		f, old := flags[i], *flags[i]
+		*f = value
+		t.Cleanup(func() { *f = old })
+	}
+	store := sessions
+	sessions = NewSessionRegistry(time.Minute)
+	t.Cleanup(func() { sessions = store })
+}
+
+func TestSessionQuotaAcquireRelease(t *testing.T) {
+	setQuotas(t, 2, 3, 0, 4)
+	q := newSessionQuota()
+
+	admin := &ConnInfo{ClusterName: "a", Namespace: "default", Owner: "admin"}
+	if errInfo := q.Acquire(admin); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+	if errInfo := q.Acquire(admin); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+	errInfo := q.Acquire(admin)
+	if errInfo == nil || errInfo.Code != http.StatusTooManyRequests || !strings.Contains(errInfo.Msg, "per user") {
+		t.Fatalf("got %+v, want quota per user exceeded", errInfo)
+	}
+
+	// the rejected session takes nothing
+	guest := &ConnInfo{ClusterName: "a", Namespace: "default", Owner: "guest"}
+	if errInfo = q.Acquire(guest); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+	if errInfo = q.Acquire(&ConnInfo{ClusterName: "a", Owner: "other"}); errInfo == nil || !strings.Contains(errInfo.Msg, "per cluster") {
+		t.Fatalf("got %+v, want quota per cluster exceeded", errInfo)
+	}
+	if errInfo = q.Acquire(&ConnInfo{ClusterName: "b", Owner: "other"}); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+	if errInfo = q.Acquire(&ConnInfo{ClusterName: "c", Owner: "other"}); errInfo == nil || !strings.Contains(errInfo.Msg, "per replica") {
+		t.Fatalf("got %+v, want quota per replica exceeded", errInfo)
+	}
+
+	q.Release(admin)
+	if errInfo = q.Acquire(admin); errInfo != nil {
+		t.Fatalf("got %v after release", errInfo.Msg)
+	}
+	q.Release(admin)
+	q.Release(admin)
+	q.Release(guest)
+	if len(q.users) != 1 || len(q.clusters) != 1 || q.total != 1 {
+		t.Fatalf("got users %v, clusters %v, total %d after release", q.users, q.clusters, q.total)
+	}
+}
+
+func TestSessionQuotaCheckPending(t *testing.T) {
+	setQuotas(t, 0, 0, 2, 0)
+	q := newSessionQuota()
+
+	info := &ConnInfo{ClusterName: "a", Namespace: "default", Owner: "admin"}
+	if errInfo := q.Check(info); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+	if _, err := sessions.Issue(info); err != nil {
+		t.Fatal(err)
+	}
+	if errInfo := q.Acquire(info); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+	// one bound and one pending
+	errInfo := q.Check(info)
+	if errInfo == nil || !strings.Contains(errInfo.Msg, "per namespace exceeded, 2 of 2") {
+		t.Fatalf("got %+v, want quota per namespace exceeded", errInfo)
+	}
+	if errInfo = q.Check(&ConnInfo{ClusterName: "a", Namespace: "other"}); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+
+	// watchers take no quota
+	watcher := &ConnInfo{ClusterName: "a", Namespace: "default", Owner: "admin", WatchSession: "x"}
+	if errInfo = q.Check(watcher); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+	if errInfo = q.Acquire(watcher); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+}
+
+func TestSessionQuotaUnknownUser(t *testing.T) {
+	setQuotas(t, 1, 0, 0, 0)
+	q := newSessionQuota()
+
+	for i := 0; i < 3; i++ {
+		if errInfo := q.Acquire(&ConnInfo{ClusterName: "a"}); errInfo != nil {
+			t.Fatalf("unknown user is limited: %v", errInfo.Msg)
+		}
+	}
+	if len(q.users) != 0 {
+		t.Fatalf("got users %v", q.users)
+	}
+
+	// the web user of audit info is used without owner
+	info := &ConnInfo{ClusterName: "a", AuditRawInfo: &AuditRawInfo{WebUser: "admin"}}
+	if errInfo := q.Acquire(info); errInfo != nil {
+		t.Fatal(errInfo.Msg)
+	}
+	if errInfo := q.Acquire(info); errInfo == nil {
+		t.Fatal("quota per user is not enforced on web user")
+	}
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	"kubecube-webconsole/errdef"
+	"kubecube-webconsole/utils"
+)
+
+const (
+	castVersion     = 2
+	castExt         = ".cast"
+	castContentType = "application/x-asciicast"
+
+	castEventOutput = "o"
+	castEventInput  = "i"
+	castEventResize = "r"
+
+	// recordPendingBytes caps the events kept before the first resize, the header is written
+	// with the default size once they exceed it
+	recordPendingBytes = 64 * 1024
+	castDefaultWidth   = 80
+	castDefaultHeight  = 24
+)
+
+var sessionIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// castHeader is the first line of an asciicast v2 file, see https://docs.asciinema.org/manual/asciicast/v2/
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+
+	// fields below are ignored by asciinema player, they are used to authorize playback
+	Cluster   string `json:"cluster,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+	User      string `json:"user,omitempty"`
+}
+
+// Recorder writes a terminal session to an asciicast v2 file.
+// Header is written on the first resize, events before that are kept in memory
+// up to recordPendingBytes. All methods are safe to call on a nil Recorder.
+type Recorder struct {
+	mu           sync.Mutex
+	file         *os.File
+	header       castHeader
+	start        time.Time
+	pending      [][]byte
+	pendingBytes int
+	started      bool
+}
+
+func recordPath(sessionID string) (string, bool) {
+	if !sessionIDPattern.MatchString(sessionID) {
+		return "", false
+	}
+	return filepath.Join(*recordDir, sessionID+castExt), true
+}
+
+// newRecorder returns nil if recording is not enabled for the container
+func newRecorder(sessionID string, info *ConnInfo) *Recorder {
+	if !*enableRecord || !recordScopeList.Match(info.ClusterName, info.Namespace) {
+		return nil
+	}
+	path, ok := recordPath(sessionID)
+	if !ok {
+		clog.Error("invalid session id %v for recording", sessionID)
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		clog.Error("[%v] create recording file failed: %v", sessionID, err)
+		return nil
+	}
+
+	now := time.Now()
+	return &Recorder{
+		file:  file,
+		start: now,
+		header: castHeader{
+			Version:   castVersion,
+			Timestamp: now.Unix(),
+			Title:     fmt.Sprintf("%s/%s/%s/%s", info.ClusterName, info.Namespace, info.PodName, info.ContainerName),
+			Env:       map[string]string{"TERM": "xterm"},
+			Cluster:   info.ClusterName,
+			Namespace: info.Namespace,
+			Pod:       info.PodName,
+			Container: info.ContainerName,
+			User:      info.Owner,
+		},
+	}
+}
+
+func (r *Recorder) Resize(cols, rows uint16) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.started {
+		r.event(castEventResize, fmt.Sprintf("%dx%d", cols, rows))
+		return
+	}
+	r.writeHeader(cols, rows)
+}
+
+// writeHeader writes the header and the pending events, it must be called with lock held
+func (r *Recorder) writeHeader(cols, rows uint16) {
+	r.header.Width = cols
+	r.header.Height = rows
+	header, err := json.Marshal(r.header)
+	if err != nil {
+		clog.Error("marshal recording header failed: %v", err)
+		return
+	}
+	r.write(header)
+	for _, line := range r.pending {
+		r.write(line)
+	}
+	r.pending = nil
+	r.pendingBytes = 0
+	r.started = true
+}
+
+func (r *Recorder) Input(data string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event(castEventInput, data)
+}
+
+func (r *Recorder) Output(data []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event(castEventOutput, string(data))
+}
+
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	if !r.started {
+		clog.Warn("recording %v closed before terminal size is known, drop it", r.file.Name())
+		_ = r.file.Close()
+		_ = os.Remove(r.file.Name())
+		r.file = nil
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		clog.Error("close recording %v failed: %v", r.file.Name(), err)
+	}
+	r.file = nil
+}
+
+// event must be called with lock held
+func (r *Recorder) event(eventType string, data string) {
+	if r.file == nil {
+		return
+	}
+	line, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), eventType, data})
+	if err != nil {
+		clog.Error("marshal recording event failed: %v", err)
+		return
+	}
+	if !r.started {
+		r.pending = append(r.pending, line)
+		r.pendingBytes += len(line)
+		if r.pendingBytes > recordPendingBytes {
+			clog.Warn("terminal size of recording %v is unknown, use %dx%d", r.file.Name(), castDefaultWidth, castDefaultHeight)
+			r.writeHeader(castDefaultWidth, castDefaultHeight)
+		}
+		return
+	}
+	r.write(line)
+}
+
+func (r *Recorder) write(line []byte) {
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		clog.Error("write recording %v failed: %v", r.file.Name(), err)
+	}
+}
+
+// handleGetRecording serves the asciicast file of a session to its owner
+// or to users who can get pods in the namespace of the session
+func handleGetRecording(request *restful.Request, response *restful.Response) {
+	user := utils.GetUserFromReq(request)
+	if user == "" {
+		_ = response.WriteHeaderAndEntity(http.StatusUnauthorized, TerminalResponse{Message: "permission denied"})
+		return
+	}
+
+	path, ok := recordPath(request.PathParameter("session"))
+	if !ok {
+		errdef.HandleInternalErrorByCode(response, errdef.RecordingNotFound)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		clog.Warn("open recording %v failed: %v", path, err)
+		errdef.HandleInternalErrorByCode(response, errdef.RecordingNotFound)
+		return
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		clog.Error("read recording header of %v failed: %v", path, err)
+		errdef.HandleInternalErrorByCode(response, errdef.RecordingNotFound)
+		return
+	}
+	header := castHeader{}
+	if err = json.Unmarshal(line, &header); err != nil {
+		clog.Error("unmarshal recording header of %v failed: %v", path, err)
+		errdef.HandleInternalErrorByCode(response, errdef.InternalServerError)
+		return
+	}
+
+	if header.User != user && !isAccessAllowed(&attributes{
+		User:            user,
+		Verb:            "get",
+		Namespace:       header.Namespace,
+		Resource:        "pods",
+		ResourceRequest: true,
+		Cluster:         header.Cluster,
+	}) {
+		_ = response.WriteHeaderAndEntity(http.StatusUnauthorized, TerminalResponse{Message: "permission denied"})
+		return
+	}
+
+	response.AddHeader("Content-Type", castContentType)
+	response.WriteHeader(http.StatusOK)
+	_, _ = response.Write(line)
+	if _, err = io.Copy(response, reader); err != nil {
+		clog.Warn("send recording %v failed: %v", path, err)
+	}
+}
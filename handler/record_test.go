@@ -0,0 +1,117 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testSessionID = "3a9ae585ceaa6e3b0c72c31b0c215187"
+
+// setRecording enables recording into a temporary directory until the test ends
+func setRecording(t *testing.T) {
+	enabled, dir := *enableRecord, *recordDir
+	*enableRecord, *recordDir = true, t.TempDir()
+	t.Cleanup(func() { *enableRecord, *recordDir = enabled, dir })
+}
+
+// readRecording returns the header and the number of events of the recording
+func readRecording(t *testing.T, sessionID string) (castHeader, int) {
+	t.Helper()
+	path, _ := recordPath(sessionID)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	var header castHeader
+	if !scanner.Scan() {
+		t.Fatal("recording is empty")
+	}
+	if err = json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	events := 0
+	for scanner.Scan() {
+		events++
+	}
+	return header, events
+}
+
+func TestRecorderResize(t *testing.T) {
+	setRecording(t)
+	r := newRecorder(testSessionID, &ConnInfo{ClusterName: "a", Owner: "admin"})
+	r.Output([]byte("$ "))
+	r.Input("ls\r")
+	r.Resize(120, 40)
+	r.Output([]byte("a.txt\r\n"))
+	r.Resize(100, 30)
+	r.Close()
+
+	header, events := readRecording(t, testSessionID)
+	if header.Width != 120 || header.Height != 40 || header.User != "admin" {
+		t.Fatalf("got header %+v", header)
+	}
+	if events != 4 {
+		t.Fatalf("got %d events, want 4", events)
+	}
+}
+
+func TestRecorderPendingLimit(t *testing.T) {
+	setRecording(t)
+	r := newRecorder(testSessionID, &ConnInfo{ClusterName: "a"})
+	chunk := []byte(strings.Repeat("x", 1024))
+	for i := 0; i < recordPendingBytes/len(chunk)+1; i++ {
+		r.Output(chunk)
+	}
+	if !r.started || len(r.pending) != 0 {
+		t.Fatalf("got %d pending events after %d bytes", len(r.pending), r.pendingBytes)
+	}
+	r.Resize(120, 40)
+	r.Close()
+
+	header, events := readRecording(t, testSessionID)
+	if header.Width != castDefaultWidth || header.Height != castDefaultHeight {
+		t.Fatalf("got size %dx%d, want the default size", header.Width, header.Height)
+	}
+	if want := recordPendingBytes/len(chunk) + 2; events != want {
+		t.Fatalf("got %d events, want %d", events, want)
+	}
+}
+
+func TestRecorderClosedBeforeResize(t *testing.T) {
+	setRecording(t)
+	r := newRecorder(testSessionID, &ConnInfo{ClusterName: "a"})
+	r.Output([]byte("$ "))
+	r.Close()
+
+	path, _ := recordPath(testSessionID)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("got error %v, want the recording removed", err)
+	}
+
+	var none *Recorder
+	none.Output([]byte("$ "))
+	none.Close()
+}
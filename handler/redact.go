@@ -0,0 +1,287 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// redactedMask replaces secrets in audit messages
+const redactedMask = "******"
+
+const (
+	// redactCarryBytes of a chunk are held back until the next one, so a secret whose
+	// prefix, such as "password=", ends one chunk is still matched
+	redactCarryBytes = 256
+	// redactMaxPending limits the bytes held back by a secret not ended yet
+	redactMaxPending = 64 * 1024
+)
+
+// secretGroup is the name of the subexpression to be masked, the whole match is masked if it does not exist
+const secretGroup = "secret"
+
+// redactor finds secrets in a string
+type redactor interface {
+	// Secrets returns the start and end offsets of secrets in s
+	Secrets(s string) [][2]int
+}
+
+// regexpRedactor masks the secret group or the whole match of pattern
+type regexpRedactor struct {
+	pattern *regexp.Regexp
+	group   int
+}
+
+func newRegexpRedactor(expr string) (*regexpRedactor, error) {
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	r := &regexpRedactor{pattern: pattern}
+	for i, name := range pattern.SubexpNames() {
+		if name == secretGroup {
+			r.group = i
+		}
+	}
+	return r, nil
+}
+
+func (r *regexpRedactor) Secrets(s string) [][2]int {
+	var secrets [][2]int
+	for _, m := range r.pattern.FindAllStringSubmatchIndex(s, -1) {
+		if start, end := m[2*r.group], m[2*r.group+1]; start >= 0 {
+			secrets = append(secrets, [2]int{start, end})
+		}
+	}
+	return secrets
+}
+
+// secretDataRedactor masks values in the data section of Secrets printed as yaml or json
+type secretDataRedactor struct{}
+
+var (
+	secretDataStart = regexp.MustCompile(`^(\s*)"?data"?:\s*\{?\s*$`)
+	secretDataItem  = regexp.MustCompile(`^(\s*"?[\w.\-]+"?:\s*"?)([A-Za-z0-9+/]+={0,2})("?,?\s*)$`)
+)
+
+func (secretDataRedactor) Secrets(s string) [][2]int {
+	var secrets [][2]int
+	inData, indent, offset := false, 0, 0
+	for _, line := range strings.Split(s, "\n") {
+		start := offset
+		offset += len(line) + 1
+		if m := secretDataStart.FindStringSubmatch(line); m != nil {
+			inData, indent = true, len(m[1])
+			continue
+		}
+		if !inData {
+			continue
+		}
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" || len(line)-len(trimmed) <= indent {
+			inData = false
+			continue
+		}
+		if m := secretDataItem.FindStringSubmatchIndex(line); m != nil {
+			secrets = append(secrets, [2]int{start + m[4], start + m[5]})
+		}
+	}
+	return secrets
+}
+
+// builtinRedactors can be selected by auditRedactors flag
+var builtinRedactors = map[string]string{
+	// --password=xxx, --token xxx, mysql -pxxx
+	"password-flags": `(?i)(?:--?(?:password|passwd|pass|pwd|secret|token|api-?key)[= ]|\bmysql\w*\b[^\n]*?\s-p)(?P<secret>[^\s'"]+|'[^']*'|"[^"]*")`,
+	// export TOKEN=xxx, PGPASSWORD=xxx, password: xxx
+	"env-secrets": `(?i)\b\w*(?:password|passwd|secret|token|api_?key|access_?key)\w*\s*[=:]\s*(?P<secret>"[^"]*"|'[^']*'|[^\s"',;]+)`,
+	"bearer":      `(?i)\bbearer\s+(?P<secret>[A-Za-z0-9\-._~+/]+=*)`,
+	"jwt":         `\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`,
+	// the end may be in the next output of stdout
+	"private-key": `-----BEGIN [A-Z ]*PRIVATE KEY-----(?:[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----|[\s\S]*$)`,
+}
+
+// secretDataRedactorName selects secretDataRedactor
+const secretDataRedactorName = "secret-data"
+
+// newRedactors builds redactors from comma separated builtin names and user defined regexes
+func newRedactors(names string, patterns []string) ([]redactor, error) {
+	var redactors []redactor
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == secretDataRedactorName {
+			redactors = append(redactors, secretDataRedactor{})
+			continue
+		}
+		expr, ok := builtinRedactors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redactor %s", name)
+		}
+		r, err := newRegexpRedactor(expr)
+		if err != nil {
+			return nil, err
+		}
+		redactors = append(redactors, r)
+	}
+	for _, expr := range patterns {
+		r, err := newRegexpRedactor(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %s: %v", expr, err)
+		}
+		redactors = append(redactors, r)
+	}
+	return redactors, nil
+}
+
+// findSecrets returns the secrets found by all redactors in s, sorted and merged if they overlap
+func findSecrets(redactors []redactor, s string) [][2]int {
+	var secrets [][2]int
+	for _, r := range redactors {
+		secrets = append(secrets, r.Secrets(s)...)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i][0] < secrets[j][0] })
+	merged := secrets[:0]
+	for _, secret := range secrets {
+		if n := len(merged); n > 0 && secret[0] <= merged[n-1][1] {
+			if secret[1] > merged[n-1][1] {
+				merged[n-1][1] = secret[1]
+			}
+			continue
+		}
+		merged = append(merged, secret)
+	}
+	return merged
+}
+
+// mask replaces the secrets in s[:end], secrets passing end are masked up to end
+func mask(s string, secrets [][2]int, end int) string {
+	var b strings.Builder
+	last := 0
+	for _, secret := range secrets {
+		if secret[0] >= end {
+			break
+		}
+		b.WriteString(s[last:secret[0]])
+		b.WriteString(redactedMask)
+		last = secret[1]
+		if last > end {
+			last = end
+		}
+	}
+	b.WriteString(s[last:end])
+	return b.String()
+}
+
+func redact(redactors []redactor, s string) string {
+	if len(redactors) == 0 || s == "" {
+		return s
+	}
+	return mask(s, findSecrets(redactors, s), len(s))
+}
+
+// redactAudit masks secrets in msg before it is published
+func redactAudit(msg *AuditMsg) {
+	msg.Data = redact(auditRedactors, msg.Data)
+	msg.Keystrokes = redact(auditRedactors, msg.Keystrokes)
+}
+
+// redactStream masks secrets in a stream written in chunks, such as stdout of a session.
+// The end of each chunk is held back and matched again with the next chunk, so a secret
+// split across chunks is masked as a whole.
+type redactStream struct {
+	redactors []redactor
+
+	mu      sync.Mutex
+	pending string
+}
+
+func newRedactStream(redactors []redactor) *redactStream {
+	return &redactStream{redactors: redactors}
+}
+
+// Write returns the masked text which can be published, it may be empty
+func (s *redactStream) Write(p string) string {
+	if len(s.redactors) == 0 {
+		return p
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	text := s.pending + p
+	secrets := findSecrets(s.redactors, text)
+	cut := len(text) - redactCarryBytes
+	for i := len(secrets) - 1; i >= 0; i-- {
+		start, end := secrets[i][0], secrets[i][1]
+		switch {
+		case end == len(text):
+			// the secret may go on in the next chunk, it is held back with the text before
+			// which makes it a secret, such as "password="
+			if start-redactCarryBytes < cut {
+				cut = start - redactCarryBytes
+			}
+		case start < cut && end > cut:
+			// a secret is not cut
+			cut = start
+		}
+	}
+	if len(text)-cut > redactMaxPending {
+		cut = len(text)
+	}
+	for cut > 0 && cut < len(text) && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if cut <= 0 {
+		s.pending = text
+		return ""
+	}
+	s.pending = text[cut:]
+	return mask(text, secrets, cut)
+}
+
+// Flush returns the masked text held back
+func (s *redactStream) Flush() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	text := s.pending
+	s.pending = ""
+	return redact(s.redactors, text)
+}
+
+func init() {
+	flag.Var(&auditRedactPatterns, "auditRedactPatterns", "regex of secrets to mask in audit messages, only the subexpression named 'secret' is masked if it exists, can be set multiple times")
+}
+
+// stringListFlag is a flag which can be set multiple times
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const scopeWildcard = "*"
+
+// scope matches a cluster and optional namespace, "*" matches any
+type scope struct {
+	Cluster   string
+	Namespace string
+}
+
+// scopeList is parsed from flags like "cluster1,cluster2/namespace1,*/kube-system"
+type scopeList []scope
+
+func parseScopeList(s string) scopeList {
+	var list scopeList
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sc := scope{Cluster: item, Namespace: scopeWildcard}
+		if idx := strings.Index(item, "/"); idx >= 0 {
+			sc.Cluster = item[:idx]
+			sc.Namespace = item[idx+1:]
+		}
+		list = append(list, sc)
+	}
+	return list
+}
+
+func (sc scope) Match(cluster, namespace string) bool {
+	return (sc.Cluster == scopeWildcard || sc.Cluster == cluster) &&
+		(sc.Namespace == scopeWildcard || sc.Namespace == namespace)
+}
+
+// Match returns true if any scope in list matches, an empty list matches everything
+func (l scopeList) Match(cluster, namespace string) bool {
+	if len(l) == 0 {
+		return true
+	}
+	for _, sc := range l {
+		if sc.Match(cluster, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopedDuration is a duration of the clusters and namespaces of scope
+type scopedDuration struct {
+	scope
+	Duration time.Duration
+}
+
+// scopedDurations is parsed from flags like "cluster1=1h,cluster2/namespace1=10m,*/kube-system=5m"
+type scopedDurations []scopedDuration
+
+func parseScopedDurations(s string) (scopedDurations, error) {
+	var list scopedDurations
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		idx := strings.LastIndex(item, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid scoped duration %q, expect scope=duration", item)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(item[idx+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid scoped duration %q: %v", item, err)
+		}
+		sc := parseScopeList(item[:idx])
+		if len(sc) != 1 {
+			return nil, fmt.Errorf("invalid scoped duration %q, expect scope=duration", item)
+		}
+		list = append(list, scopedDuration{scope: sc[0], Duration: d})
+	}
+	return list, nil
+}
+
+// specificity is the number of non wildcard fields of scope
+func (sc scope) specificity() int {
+	n := 0
+	if sc.Cluster != scopeWildcard {
+		n++
+	}
+	if sc.Namespace != scopeWildcard {
+		n++
+	}
+	return n
+}
+
+// Get returns the duration of the most specific scope matching, or def if none matches.
+// The first one wins if several scopes are equally specific.
+func (l scopedDurations) Get(cluster, namespace string, def time.Duration) time.Duration {
+	best := -1
+	d := def
+	for _, sd := range l {
+		if !sd.Match(cluster, namespace) {
+			continue
+		}
+		if n := sd.specificity(); n > best {
+			best, d = n, sd.Duration
+		}
+	}
+	return d
+}
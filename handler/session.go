@@ -0,0 +1,158 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	"kubecube-webconsole/utils"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found or already bound")
+	ErrSessionExpired  = errors.New("session expired")
+	ErrSessionOwner    = errors.New("session does not belong to current user")
+	ErrSessionNoOwner  = errors.New("session without owner can not be issued")
+)
+
+// pendingSession is a session id issued by the REST api which has not been bound by SockJS yet
+type pendingSession struct {
+	info     *ConnInfo
+	deadline time.Time
+}
+
+// SessionStore keeps the container-connect info of issued session ids until they are bound.
+// A session id can be bound only once, only by the user who requested it and only before its bind deadline.
+// A bind by another user leaves the session to its owner, and sessions without owner are never issued.
+type SessionStore interface {
+	// Issue generates a new session id for given container-connect info
+	Issue(info *ConnInfo) (string, error)
+	// Consume removes the session and returns its container-connect info if user owns it
+	Consume(id string, user string) (*ConnInfo, error)
+	// Pending returns the number of sessions waiting for bind whose info matches
+	Pending(match func(info *ConnInfo) bool) int
+	// Len returns the number of sessions waiting for bind
+	Len() int
+	// Expire removes all sessions which passed their bind deadline
+	Expire()
+}
+
+// session stores
+const (
+	SessionStoreMemory     = "memory"
+	SessionStoreKubernetes = "kubernetes"
+)
+
+// SessionRegistry is the SessionStore in memory, the session id must be bound by the replica issued it.
+// Expired ones are removed in background.
+type SessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*pendingSession
+	ttl      time.Duration
+}
+
+func NewSessionRegistry(ttl time.Duration) *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]*pendingSession),
+		ttl:      ttl,
+	}
+}
+
+// Issue generates a new session id for given container-connect info
+func (r *SessionRegistry) Issue(info *ConnInfo) (string, error) {
+	if info.Owner == "" {
+		return "", ErrSessionNoOwner
+	}
+	id, err := utils.GenTerminalSessionId()
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	r.sessions[id] = &pendingSession{info: info, deadline: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+
+	return id, nil
+}
+
+// Consume removes the session from registry and returns its container-connect info,
+// the session is kept if the owner does not match, so a leaked id can not be burnt by other users.
+// Expired sessions are removed.
+func (r *SessionRegistry) Consume(id string, user string) (*ConnInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	info, err := s.bind(id, user)
+	if err == ErrSessionOwner {
+		return nil, err
+	}
+	delete(r.sessions, id)
+	return info, err
+}
+
+// bind returns the container-connect info if the session can be bound by user now
+func (s *pendingSession) bind(id string, user string) (*ConnInfo, error) {
+	if time.Now().After(s.deadline) {
+		return nil, ErrSessionExpired
+	}
+	if s.info.Owner == "" || s.info.Owner != user {
+		clog.Warn("session %v is owned by %v but bound by %v", id, s.info.Owner, user)
+		return nil, ErrSessionOwner
+	}
+	return s.info, nil
+}
+
+// Len returns the number of sessions waiting for bind
+func (r *SessionRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// Pending returns the number of sessions waiting for bind whose info matches
+func (r *SessionRegistry) Pending(match func(info *ConnInfo) bool) int {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, s := range r.sessions {
+		if now.Before(s.deadline) && match(s.info) {
+			n++
+		}
+	}
+	return n
+}
+
+// Expire removes all sessions which passed their bind deadline
+func (r *SessionRegistry) Expire() {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, s := range r.sessions {
+		if now.After(s.deadline) {
+			clog.Debug("session %v expired without bind", id)
+			delete(r.sessions, id)
+		}
+	}
+}
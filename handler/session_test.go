@@ -0,0 +1,142 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSessionRegistrySingleUse(t *testing.T) {
+	r := NewSessionRegistry(time.Minute)
+	info := &ConnInfo{ClusterName: "pivot-cluster", Namespace: "default", PodName: "nginx", Owner: "admin"}
+	id, err := r.Issue(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 1 {
+		t.Fatalf("got %d sessions, want 1", r.Len())
+	}
+
+	got, err := r.Consume(id, "admin")
+	if err != nil || got != info {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	if _, err = r.Consume(id, "admin"); err != ErrSessionNotFound {
+		t.Fatalf("got error %v binding twice, want %v", err, ErrSessionNotFound)
+	}
+	if _, err = r.Consume("unknown", "admin"); err != ErrSessionNotFound {
+		t.Fatalf("got error %v binding unknown id, want %v", err, ErrSessionNotFound)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("got %d sessions after bind, want 0", r.Len())
+	}
+}
+
+func TestSessionRegistryOwner(t *testing.T) {
+	r := NewSessionRegistry(time.Minute)
+	id, err := r.Issue(&ConnInfo{Owner: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"guest", ""} {
+		if _, err = r.Consume(id, user); err != ErrSessionOwner {
+			t.Fatalf("got error %v binding by %q, want %v", err, user, ErrSessionOwner)
+		}
+	}
+	// the id is not burnt by other users
+	if _, err = r.Consume(id, "admin"); err != nil {
+		t.Fatalf("got error %v after owner mismatch", err)
+	}
+
+	if _, err = r.Issue(&ConnInfo{}); err != ErrSessionNoOwner {
+		t.Fatalf("got error %v issuing session without owner, want %v", err, ErrSessionNoOwner)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("got %d sessions, want 0", r.Len())
+	}
+}
+
+func TestSessionRegistryExpiry(t *testing.T) {
+	r := NewSessionRegistry(time.Millisecond)
+	expired, err := r.Issue(&ConnInfo{Owner: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err = r.Consume(expired, "admin"); err != ErrSessionExpired {
+		t.Fatalf("got error %v, want %v", err, ErrSessionExpired)
+	}
+
+	if _, err = r.Issue(&ConnInfo{Owner: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if r.Pending(func(*ConnInfo) bool { return true }) != 0 {
+		t.Fatal("expired sessions are pending")
+	}
+	r.Expire()
+	if r.Len() != 0 {
+		t.Fatalf("got %d sessions after expire, want 0", r.Len())
+	}
+}
+
+func TestSessionRegistryPending(t *testing.T) {
+	r := NewSessionRegistry(time.Minute)
+	for _, info := range []*ConnInfo{
+		{ClusterName: "a", Owner: "admin"},
+		{ClusterName: "a", Owner: "guest"},
+		{ClusterName: "b", Owner: "admin"},
+	} {
+		if _, err := r.Issue(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := r.Pending(func(info *ConnInfo) bool { return info.Owner == "admin" }); n != 2 {
+		t.Fatalf("got %d pending sessions of admin, want 2", n)
+	}
+	if n := r.Pending(func(info *ConnInfo) bool { return info.ClusterName == "b" }); n != 1 {
+		t.Fatalf("got %d pending sessions of cluster b, want 1", n)
+	}
+}
+
+func TestSessionCredentials(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token")
+	header.Set("Cookie", "Authorization=Bearer token")
+	header.Set("X-Request-Id", "1")
+	info := &ConnInfo{IsControlCluster: true, Header: header}
+
+	stripped := withoutCredentials(info)
+	if stripped.Header.Get("Authorization") != "" || stripped.Header.Get("Cookie") != "" || stripped.Header.Get("X-Request-Id") != "1" {
+		t.Fatalf("got header %v", stripped.Header)
+	}
+	if info.Header.Get("Authorization") == "" {
+		t.Fatal("header of the request is changed")
+	}
+
+	restoreCredentials(stripped, "bound")
+	if got := stripped.Header.Get("Authorization"); got != "Bearer bound" {
+		t.Fatalf("got authorization %q after bind", got)
+	}
+	// the header of the request is kept by the memory store
+	restoreCredentials(info, "bound")
+	if got := info.Header.Get("Authorization"); got != "Bearer token" {
+		t.Fatalf("got authorization %q of memory store", got)
+	}
+}
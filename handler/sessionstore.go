@@ -0,0 +1,229 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/kubecube-io/kubecube/pkg/clients"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	"github.com/kubecube-io/kubecube/pkg/utils/constants"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"kubecube-webconsole/utils"
+)
+
+const (
+	sessionSecretPrefix       = "webconsole-session-"
+	sessionSecretType         = "kubecube.io/webconsole-session"
+	sessionSecretInfoKey      = "info"
+	sessionDeadlineAnnotation = "kubecube.io/webconsole-session-deadline"
+	sessionStoreLabelKey      = "kubecube.io/app"
+	sessionStoreLabelValue    = "kubecube-webconsole-session"
+	sessionIssuerLabelKey     = "kubecube.io/webconsole-issuer"
+	// timeout of each request to the pivot cluster
+	kubeSessionStoreTimeout = 5 * time.Second
+)
+
+// kubeSessionStore keeps each session waiting for bind as a Secret in the namespace of pivot
+// cluster, so the session id can be bound by any replica. The Secret is deleted with the
+// precondition of its uid and resource version when bound, only one replica can consume it.
+// The Secret is labeled with the replica issued it, so the quotas of a replica count only the
+// sessions it issued.
+type kubeSessionStore struct {
+	namespace string
+	ttl       time.Duration
+	issuer    string
+}
+
+func newKubeSessionStore(namespace string, ttl time.Duration) (*kubeSessionStore, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &kubeSessionStore{namespace: namespace, ttl: ttl, issuer: hostname}, nil
+}
+
+func (k *kubeSessionStore) secrets() typedv1.SecretInterface {
+	return clients.Interface().Kubernetes(constants.LocalCluster).ClientSet().CoreV1().Secrets(k.namespace)
+}
+
+func (k *kubeSessionStore) Issue(info *ConnInfo) (string, error) {
+	if info.Owner == "" {
+		return "", ErrSessionNoOwner
+	}
+	id, err := utils.GenTerminalSessionId()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(withoutCredentials(info))
+	if err != nil {
+		return "", err
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        sessionSecretPrefix + id,
+			Namespace:   k.namespace,
+			Labels:      map[string]string{sessionStoreLabelKey: sessionStoreLabelValue, sessionIssuerLabelKey: k.issuer},
+			Annotations: map[string]string{sessionDeadlineAnnotation: time.Now().Add(k.ttl).Format(time.RFC3339Nano)},
+		},
+		Type: sessionSecretType,
+		Data: map[string][]byte{sessionSecretInfoKey: data},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeSessionStoreTimeout)
+	defer cancel()
+	if _, err = k.secrets().Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Consume binds the session before it is deleted, so a bind with the wrong owner leaves the session
+// to its owner until the deadline, and a replica failing between the checks and the delete can not
+// consume a session no one gets.
+func (k *kubeSessionStore) Consume(id string, user string) (*ConnInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeSessionStoreTimeout)
+	defer cancel()
+
+	secret, err := k.secrets().Get(ctx, sessionSecretPrefix+id, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := decodeSessionSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	info, bindErr := s.bind(id, user)
+	if bindErr == ErrSessionOwner {
+		return nil, bindErr
+	}
+
+	// expired sessions are deleted as well, the leader would do it later anyway
+	err = k.secrets().Delete(ctx, secret.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &secret.UID, ResourceVersion: &secret.ResourceVersion},
+	})
+	if errors.IsNotFound(err) || errors.IsConflict(err) {
+		// consumed by another replica
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, bindErr
+}
+
+// list returns the sessions of all replicas, or only the ones issued by this replica if local is true
+func (k *kubeSessionStore) list(local bool) []*v1.Secret {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeSessionStoreTimeout)
+	defer cancel()
+	selector := labels.Set{sessionStoreLabelKey: sessionStoreLabelValue}
+	if local {
+		selector[sessionIssuerLabelKey] = k.issuer
+	}
+	list, err := k.secrets().List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		clog.Error("list sessions in namespace %v failed: %v", k.namespace, err)
+		return nil
+	}
+	secrets := make([]*v1.Secret, 0, len(list.Items))
+	for i := range list.Items {
+		secrets = append(secrets, &list.Items[i])
+	}
+	return secrets
+}
+
+// Pending counts sessions issued by this replica, the same as the memory store. They are
+// filtered by label in the pivot cluster, so only the few Secrets of this replica are listed.
+func (k *kubeSessionStore) Pending(match func(info *ConnInfo) bool) int {
+	return k.count(true, match)
+}
+
+// Len counts sessions of all replicas
+func (k *kubeSessionStore) Len() int {
+	return k.count(false, func(*ConnInfo) bool { return true })
+}
+
+func (k *kubeSessionStore) count(local bool, match func(info *ConnInfo) bool) int {
+	now := time.Now()
+	n := 0
+	for _, secret := range k.list(local) {
+		s, err := decodeSessionSecret(secret)
+		if err != nil || now.After(s.deadline) {
+			continue
+		}
+		if match(s.info) {
+			n++
+		}
+	}
+	return n
+}
+
+func (k *kubeSessionStore) Expire() {
+	now := time.Now()
+	for _, secret := range k.list(false) {
+		s, err := decodeSessionSecret(secret)
+		if err == nil && !now.After(s.deadline) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), kubeSessionStoreTimeout)
+		err = k.secrets().Delete(ctx, secret.Name, metav1.DeleteOptions{})
+		cancel()
+		if err != nil && !errors.IsNotFound(err) {
+			clog.Warn("delete expired session %v failed: %v", secret.Name, err)
+			continue
+		}
+		clog.Debug("session %v expired without bind", secret.Name)
+	}
+}
+
+// credentialHeaders are not persisted in Secrets, the cloud shell gets the token of bind message instead
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// withoutCredentials returns a copy of info without the credential headers of the request
+func withoutCredentials(info *ConnInfo) *ConnInfo {
+	if info.Header == nil {
+		return info
+	}
+	stripped := *info
+	stripped.Header = info.Header.Clone()
+	for _, key := range credentialHeaders {
+		stripped.Header.Del(key)
+	}
+	return &stripped
+}
+
+func decodeSessionSecret(secret *v1.Secret) (*pendingSession, error) {
+	deadline, err := time.Parse(time.RFC3339Nano, secret.Annotations[sessionDeadlineAnnotation])
+	if err != nil {
+		return nil, err
+	}
+	info := &ConnInfo{}
+	if err = json.Unmarshal(secret.Data[sessionSecretInfoKey], info); err != nil {
+		return nil, err
+	}
+	return &pendingSession{info: info, deadline: deadline}, nil
+}
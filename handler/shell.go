@@ -0,0 +1,144 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// shellCandidates are commands of shells tried in order, such as [["/bin/bash"], ["/bin/busybox", "sh"]]
+type shellCandidates [][]string
+
+// imageShellOverride overrides the shell candidates for images matching Pattern
+type imageShellOverride struct {
+	Pattern string
+	Shells  shellCandidates
+}
+
+// parseShells parses flags like "/bin/bash,/bin/sh,/bin/busybox sh"
+func parseShells(s string) shellCandidates {
+	var shells shellCandidates
+	for _, item := range strings.Split(s, ",") {
+		if cmd := strings.Fields(item); len(cmd) > 0 {
+			shells = append(shells, cmd)
+		}
+	}
+	return shells
+}
+
+// parseImageShells parses flags like "alpine*=/bin/ash,/bin/sh;*/distroless/*=/busybox/sh"
+func parseImageShells(s string) ([]imageShellOverride, error) {
+	var list []imageShellOverride
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		idx := strings.Index(item, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid image shells %s", item)
+		}
+		pattern := item[:idx]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid image pattern %s: %v", pattern, err)
+		}
+		list = append(list, imageShellOverride{Pattern: pattern, Shells: parseShells(item[idx+1:])})
+	}
+	return list, nil
+}
+
+// shellsForImage returns shells of the first override matching image, or the default shells.
+// Patterns with "/" match the whole image reference, others match its last path element,
+// so alpine* matches docker.io/library/alpine:3
+func shellsForImage(image string) shellCandidates {
+	for _, override := range imageShellList {
+		name := image
+		if !strings.Contains(override.Pattern, "/") {
+			name = path.Base(image)
+		}
+		if ok, _ := path.Match(override.Pattern, name); ok {
+			return override.Shells
+		}
+	}
+	return defaultShellList
+}
+
+// discoverShell finds the first shell which can run in the container by a non-tty exec,
+// so the interactive exec never fails because of a missing shell
+func discoverShell(k8sClient *rest.RESTClient, cfg *rest.Config, info *ConnInfo) ([]string, error) {
+	image, err := getContainerImage(k8sClient, info)
+	if err != nil {
+		clog.Warn("get image of container %v of pod %v failed, use default shells: %v", info.ContainerName, info.PodName, err)
+	}
+	candidates := shellsForImage(image)
+
+	for _, shell := range candidates {
+		probe := append(append([]string(nil), shell...), "-c", "exit 0")
+		if err := execStream(k8sClient, cfg, info, probe, nil, ioutil.Discard, ioutil.Discard); err != nil {
+			clog.Debug("shell %v is not available in container %v of pod %v: %v", shell, info.ContainerName, info.PodName, err)
+			continue
+		}
+		return shell, nil
+	}
+	return nil, fmt.Errorf("no shell found in container %s, tried %v", info.ContainerName, candidates)
+}
+
+// scriptFound probes the script by a non-tty exec of shell, like discoverShell probes shells
+func scriptFound(k8sClient *rest.RESTClient, cfg *rest.Config, info *ConnInfo, shell []string) bool {
+	probe := append(append([]string(nil), shell...), "-c", `test -x "$0"`, *scriptName)
+	if err := execStream(k8sClient, cfg, info, probe, nil, ioutil.Discard, ioutil.Discard); err != nil {
+		clog.Debug("script %v is not available in container %v of pod %v: %v", *scriptName, info.ContainerName, info.PodName, err)
+		return false
+	}
+	return true
+}
+
+func getContainerImage(k8sClient *rest.RESTClient, info *ConnInfo) (string, error) {
+	pod := v1.Pod{}
+	err := k8sClient.Get().
+		Resource("pods").
+		Name(info.PodName).
+		Namespace(info.Namespace).
+		Do(context.Background()).
+		Into(&pod)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == info.ContainerName {
+			return c.Image, nil
+		}
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		if c.Name == info.ContainerName {
+			return c.Image, nil
+		}
+	}
+	// the first container is used if container is not specified
+	if info.ContainerName == "" && len(pod.Spec.Containers) > 0 {
+		return pod.Spec.Containers[0].Image, nil
+	}
+	return "", fmt.Errorf("container %s not found", info.ContainerName)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShellsForImage(t *testing.T) {
+	list, err := parseImageShells("alpine*=/bin/ash,/bin/sh; */distroless/*=/busybox/sh ;docker.io/library/busybox*=/bin/busybox sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(list []imageShellOverride, shells shellCandidates) {
+		imageShellList, defaultShellList = list, shells
+	}(imageShellList, defaultShellList)
+	imageShellList, defaultShellList = list, parseShells("/bin/bash,/bin/sh")
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"alpine", "/bin/ash|/bin/sh"},
+		{"alpine:3", "/bin/ash|/bin/sh"},
+		{"docker.io/library/alpine:3", "/bin/ash|/bin/sh"},
+		{"registry.local:5000/base/alpine-git@sha256:abc", "/bin/ash|/bin/sh"},
+		{"gcr.io/distroless/base:latest", "/busybox/sh"},
+		{"docker.io/library/busybox:1.36", "/bin/busybox sh"},
+		{"busybox:1.36", "/bin/bash|/bin/sh"},
+		{"nginx:alpine", "/bin/bash|/bin/sh"},
+		{"", "/bin/bash|/bin/sh"},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, shell := range shellsForImage(tt.image) {
+			got = append(got, strings.Join(shell, " "))
+		}
+		if strings.Join(got, "|") != tt.want {
+			t.Errorf("%q: got shells %q, want %q", tt.image, got, tt.want)
+		}
+	}
+
+	if _, err = parseImageShells("[alpine=/bin/sh"); err == nil {
+		t.Fatal("parsed invalid pattern")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kubecube-io/kubecube/pkg/clog"
+)
+
+const (
+	// drainPollInterval is how often Drain checks whether sessions ended
+	drainPollInterval = 500 * time.Millisecond
+	// drainCloseWait is how long Drain waits for closed sessions to finish their audit
+	drainCloseWait = 5 * time.Second
+)
+
+// draining is set to 1 once the server starts to shut down, accessed atomically
+var draining int32
+
+// IsDraining returns true if the server is shutting down and issues no more session ids
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// Drain is called on SIGTERM. It stops issuing session ids, tells users of running sessions
+// by toast, waits shutdownDrainPeriod for the sessions to end and closes the rest, then
+// flushes queued audit messages within auditFlushTimeout.
+func Drain() {
+	atomic.StoreInt32(&draining, 1)
+
+	notice := fmt.Sprintf("Server is shutting down, the session will be closed in %v. Please reconnect after it is closed.", *shutdownDrainPeriod)
+	clog.Info("draining %d running sessions and %d connections within %v", liveSessions.Len(), drainConns.Len(), *shutdownDrainPeriod)
+	for _, t := range liveSessions.All() {
+		_ = t.Toast(notice)
+	}
+	for _, c := range drainConns.All() {
+		_ = c.Toast(notice)
+	}
+
+	if !waitSessionsEnd(*shutdownDrainPeriod) {
+		clog.Info("close %d sessions and %d connections still running after %v", liveSessions.Len(), drainConns.Len(), *shutdownDrainPeriod)
+		for _, t := range liveSessions.All() {
+			t.Close(CloseStatusShutdown, "server is shutting down")
+		}
+		for _, c := range drainConns.All() {
+			c.Close(CloseStatusShutdown, "server is shutting down")
+		}
+		if !waitSessionsEnd(drainCloseWait) {
+			clog.Warn("%d sessions and %d connections do not end after closed", liveSessions.Len(), drainConns.Len())
+		}
+	}
+
+	if auditSinks != nil && auditSinks.Flush(*auditFlushTimeout) {
+		clog.Info("audit messages are flushed")
+	}
+}
+
+// waitSessionsEnd returns true if all running sessions and connections end within timeout
+func waitSessionsEnd(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for liveSessions.Len()+drainConns.Len() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return true
+}
+
+// drainConn is a connection closed by Drain besides the terminal sessions in liveSessions
+type drainConn struct {
+	conn   TerminalConn
+	closer *sessionCloser
+	toast  bool // false if the client can not show toast, such as port forwards
+}
+
+func (c drainConn) Toast(data string) error {
+	if !c.toast {
+		return nil
+	}
+	return sendToast(c.conn, data)
+}
+
+// Close closes the connection, the first close wins
+func (c drainConn) Close(status uint32, reason string) {
+	c.closer.close(status, reason, func() {
+		_ = c.conn.Close(status, reason)
+	})
+}
+
+// connRegistry keeps running watchers and port forwards by session id
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]drainConn
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[string]drainConn)}
+}
+
+// Add registers the connection of session id, it must be removed once the session ends
+func (r *connRegistry) Add(id string, conn TerminalConn, toast bool) drainConn {
+	c := drainConn{conn: conn, closer: &sessionCloser{}, toast: toast}
+	r.mu.Lock()
+	r.conns[id] = c
+	r.mu.Unlock()
+	return c
+}
+
+func (r *connRegistry) Remove(id string) {
+	r.mu.Lock()
+	delete(r.conns, id)
+	r.mu.Unlock()
+}
+
+func (r *connRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+func (r *connRegistry) All() []drainConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]drainConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
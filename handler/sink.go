@@ -0,0 +1,475 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+	"k8s.io/klog/v2"
+)
+
+// names of audit sinks in auditSinks flag
+const (
+	AuditSinkHTTP   = "http"
+	AuditSinkFile   = "file"
+	AuditSinkSyslog = "syslog"
+	AuditSinkStdout = "stdout"
+)
+
+const (
+	// facility local0 and severity informational
+	syslogPriority  = 16*8 + 6
+	syslogAppName   = "kubecube-webconsole"
+	syslogMsgID     = "audit"
+	syslogDialWait  = 5 * time.Second
+	syslogWriteWait = 5 * time.Second
+
+	auditFlushPollInterval = 100 * time.Millisecond
+)
+
+// AuditSink delivers audit messages to one destination
+type AuditSink interface {
+	Name() string
+	// Publish returns error if the message is not delivered
+	Publish(payload string, id string) error
+}
+
+type auditRecord struct {
+	Payload string `json:"payload"`
+	ID      string `json:"id"`
+}
+
+// auditQueue buffers the records of one sink and delivers them in background
+type auditQueue interface {
+	Push(r auditRecord) error
+	// Depth returns the records not delivered yet
+	Depth() int64
+}
+
+// AuditQueueStatus is the backlog of an audit sink
+type AuditQueueStatus struct {
+	Sink    string `json:"sink"`
+	Durable bool   `json:"durable"`
+	Backlog int64  `json:"backlog"`
+}
+
+// auditFanout publishes each message to all sinks, every sink has its own queue
+// and goroutine so a slow or failing sink never blocks the others
+type auditFanout struct {
+	sinks  []AuditSink
+	queues []auditQueue
+}
+
+// newAuditFanout spools messages of each sink in a sub directory of spoolDir,
+// or keeps them in memory if spoolDir is empty
+func newAuditFanout(sinks []AuditSink, queueSize int, spoolDir string) (*auditFanout, error) {
+	f := &auditFanout{sinks: sinks}
+	for _, sink := range sinks {
+		var (
+			q   auditQueue
+			err error
+		)
+		if spoolDir != "" {
+			q, err = newAuditSpool(filepath.Join(spoolDir, sink.Name()), sink, *auditSpoolMaxBytes)
+		} else {
+			q, err = newMemoryAuditQueue(sink, queueSize, *auditWorkers, *auditOverloadPolicy)
+		}
+		if err != nil {
+			return nil, err
+		}
+		registerAuditQueueDepth(sink.Name(), q)
+		f.queues = append(f.queues, q)
+	}
+	return f, nil
+}
+
+func (f *auditFanout) Publish(payload string, id string) {
+	for i, q := range f.queues {
+		if err := q.Push(auditRecord{Payload: payload, ID: id}); err != nil {
+			auditMessages.WithLabelValues(f.sinks[i].Name(), auditResultDropped).Inc()
+			klog.Errorf("[%v] audit message to sink %v dropped: %v", id, f.sinks[i].Name(), err)
+		}
+	}
+}
+
+// Status returns the backlog of every sink
+func (f *auditFanout) Status() []AuditQueueStatus {
+	var status []AuditQueueStatus
+	for i, q := range f.queues {
+		_, durable := q.(*auditSpool)
+		status = append(status, AuditQueueStatus{Sink: f.sinks[i].Name(), Durable: durable, Backlog: q.Depth()})
+	}
+	return status
+}
+
+// Flush waits until messages of all sinks are delivered, it returns false if
+// some are not delivered within timeout
+func (f *auditFanout) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		var backlog int64
+		for _, q := range f.queues {
+			backlog += q.Depth()
+		}
+		if backlog == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			klog.Warningf("%d audit messages are not delivered within %v", backlog, timeout)
+			return false
+		}
+		time.Sleep(auditFlushPollInterval)
+	}
+}
+
+// policies when the memory audit queue is full
+const (
+	// AuditOverloadDropOldest drops the oldest message in queue to make room for the new one
+	AuditOverloadDropOldest = "drop-oldest"
+	// AuditOverloadBlock blocks the session until there is room, so audit is never lost
+	// but the terminal is slowed down to the speed of the sink
+	AuditOverloadBlock = "block"
+	// AuditOverloadSpill appends the new message to a spool on disk under auditSpillDir,
+	// which is delivered by its own goroutine
+	AuditOverloadSpill = "spill"
+)
+
+// memoryAuditQueue is delivered by a pool of workers in batches, a batch is
+// flushed when it reaches auditBatchSize or auditBatchInterval passed.
+// A batch is dropped after MaxRetry retries.
+type memoryAuditQueue struct {
+	sink    AuditSink
+	records chan auditRecord
+	policy  string
+	spill   *auditSpool
+	pending int64 // records pushed to the channel and not delivered or dropped yet, accessed atomically
+}
+
+func newMemoryAuditQueue(sink AuditSink, size, workers int, policy string) (*memoryAuditQueue, error) {
+	q := &memoryAuditQueue{sink: sink, records: make(chan auditRecord, size), policy: policy}
+	switch policy {
+	case AuditOverloadDropOldest, AuditOverloadBlock:
+	case AuditOverloadSpill:
+		spill, err := newAuditSpool(filepath.Join(*auditSpillDir, sink.Name()), sink, *auditSpoolMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		q.spill = spill
+	default:
+		return nil, fmt.Errorf("unknown audit overload policy %s", policy)
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q, nil
+}
+
+func (q *memoryAuditQueue) Push(r auditRecord) error {
+	// counted before it is sent, so it is never in the channel without counted
+	atomic.AddInt64(&q.pending, 1)
+	select {
+	case q.records <- r:
+		return nil
+	default:
+	}
+
+	switch q.policy {
+	case AuditOverloadBlock:
+		auditMessages.WithLabelValues(q.sink.Name(), auditResultBlocked).Inc()
+		q.records <- r
+		return nil
+	case AuditOverloadSpill:
+		atomic.AddInt64(&q.pending, -1)
+		if err := q.spill.Push(r); err != nil {
+			return err
+		}
+		auditMessages.WithLabelValues(q.sink.Name(), auditResultSpilled).Inc()
+		return nil
+	}
+	for {
+		select {
+		case q.records <- r:
+			return nil
+		case old := <-q.records:
+			atomic.AddInt64(&q.pending, -1)
+			auditMessages.WithLabelValues(q.sink.Name(), auditResultDropped).Inc()
+			klog.Errorf("[%v] audit queue of sink %v is full, the oldest message dropped", old.ID, q.sink.Name())
+		}
+	}
+}
+
+func (q *memoryAuditQueue) Depth() int64 {
+	depth := atomic.LoadInt64(&q.pending)
+	if q.spill != nil {
+		depth += q.spill.Depth()
+	}
+	return depth
+}
+
+func (q *memoryAuditQueue) work() {
+	batch := make([]auditRecord, 0, *auditBatchSize)
+	for r := range q.records {
+		batch = append(batch[:0], r)
+		timer := time.NewTimer(*auditBatchInterval)
+	collect:
+		for len(batch) < *auditBatchSize {
+			select {
+			case r := <-q.records:
+				batch = append(batch, r)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		q.deliver(batch)
+		atomic.AddInt64(&q.pending, -int64(len(batch)))
+	}
+}
+
+func (q *memoryAuditQueue) deliver(batch []auditRecord) {
+	for i := 0; len(batch) > 0; i++ {
+		if i > MaxRetry {
+			auditMessages.WithLabelValues(q.sink.Name(), auditResultFailed).Add(float64(len(batch)))
+			klog.Errorf("[%v] publish %d audit messages to sink %v failed after %d retries", batch[0].ID, len(batch), q.sink.Name(), MaxRetry)
+			return
+		}
+		if i != 0 {
+			interval := auditRetryInterval(i)
+			klog.Warningf("[%v] send audit message to sink %v failed, retry after %v", batch[0].ID, q.sink.Name(), interval)
+			time.Sleep(interval)
+		}
+		n, err := publishRecords(q.sink, batch)
+		batch = batch[n:]
+		if err != nil {
+			klog.Errorf("publish audit message to sink %v failed: %v", q.sink.Name(), err)
+		}
+	}
+}
+
+// batchAuditSink is implemented by sinks which deliver many messages at once
+type batchAuditSink interface {
+	// PublishBatch returns the number of records delivered
+	PublishBatch(records []auditRecord) (int, error)
+}
+
+// publishRecords returns the number of records delivered in order
+func publishRecords(sink AuditSink, records []auditRecord) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	if bs, ok := sink.(batchAuditSink); ok {
+		n, err = bs.PublishBatch(records)
+	} else {
+		for _, r := range records {
+			if err = sink.Publish(r.Payload, r.ID); err != nil {
+				break
+			}
+			n++
+		}
+	}
+	if n > 0 {
+		auditMessages.WithLabelValues(sink.Name(), auditResultDelivered).Add(float64(n))
+		auditBatchSizes.WithLabelValues(sink.Name()).Observe(float64(n))
+	}
+	return n, err
+}
+
+// auditRetryInterval returns the wait before the n-th retry, it starts from
+// auditRetryMinInterval, grows 2.5 times each retry and is capped by auditRetryMaxInterval
+func auditRetryInterval(n int) time.Duration {
+	interval := *auditRetryMinInterval
+	for i := 1; i < n && interval < *auditRetryMaxInterval; i++ {
+		interval = time.Duration(float64(interval) * 2.5)
+	}
+	if interval > *auditRetryMaxInterval {
+		interval = *auditRetryMaxInterval
+	}
+	return interval
+}
+
+// newAuditSinks creates sinks from comma separated names
+func newAuditSinks(names string) ([]AuditSink, error) {
+	var sinks []AuditSink
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case AuditSinkHTTP:
+			sinks = append(sinks, newHTTPAuditSink())
+		case AuditSinkFile:
+			sinks = append(sinks, newFileAuditSink(*auditFile, *auditFileMaxSizeMB, *auditFileMaxBackups))
+		case AuditSinkSyslog:
+			sink, err := newSyslogAuditSink(*auditSyslogAddr, *auditSyslogCA)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case AuditSinkStdout:
+			sinks = append(sinks, &writerAuditSink{name: AuditSinkStdout, w: os.Stdout})
+		default:
+			return nil, fmt.Errorf("unknown audit sink %s", name)
+		}
+	}
+	return sinks, nil
+}
+
+// writerAuditSink writes one message per line
+type writerAuditSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+func (s *writerAuditSink) Name() string {
+	return s.name
+}
+
+func (s *writerAuditSink) Publish(payload string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := io.WriteString(s.w, payload+"\n")
+	return err
+}
+
+// PublishBatch writes all records at once
+func (s *writerAuditSink) PublishBatch(records []auditRecord) (int, error) {
+	var b strings.Builder
+	for _, r := range records {
+		b.WriteString(r.Payload)
+		b.WriteString("\n")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := io.WriteString(s.w, b.String()); err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// newFileAuditSink writes JSON lines to path, the file is rotated when it reaches maxSizeMB
+func newFileAuditSink(path string, maxSizeMB, maxBackups int) AuditSink {
+	return &writerAuditSink{
+		name: AuditSinkFile,
+		w: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSizeMB,
+			MaxBackups: maxBackups,
+		},
+	}
+}
+
+// syslogAuditSink sends RFC 5424 messages over udp, tcp or tls,
+// messages over tcp and tls are framed by octet counting of RFC 6587
+type syslogAuditSink struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	hostname  string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newSyslogAuditSink parses addr like udp://host:514, tcp://host:601 or tls://host:6514
+func newSyslogAuditSink(addr string, caFile string) (AuditSink, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid syslog address %s", addr)
+	}
+	s := &syslogAuditSink{network: u.Scheme, addr: u.Host}
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		s.tlsConfig = &tls.Config{}
+		if caFile != "" {
+			ca, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificate found in %s", caFile)
+			}
+			s.tlsConfig.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %s", u.Scheme)
+	}
+	if s.hostname, err = os.Hostname(); err != nil {
+		s.hostname = "-"
+	}
+	return s, nil
+}
+
+func (s *syslogAuditSink) Name() string {
+	return AuditSinkSyslog
+}
+
+func (s *syslogAuditSink) Publish(payload string, id string) error {
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		syslogPriority, time.Now().Format(time.RFC3339Nano), s.hostname, syslogAppName, os.Getpid(), syslogMsgID, payload)
+	if s.network != "udp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// reconnect once if the connection is broken
+	for i := 0; i < 2; i++ {
+		if s.conn == nil {
+			conn, err := s.dial()
+			if err != nil {
+				return err
+			}
+			s.conn = conn
+		}
+		_ = s.conn.SetWriteDeadline(time.Now().Add(syslogWriteWait))
+		_, err := io.WriteString(s.conn, msg)
+		if err == nil {
+			return nil
+		}
+		_ = s.conn.Close()
+		s.conn = nil
+		if i > 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syslogAuditSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialWait}
+	if s.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+	}
+	return dialer.Dial(s.network, s.addr)
+}
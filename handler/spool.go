@@ -0,0 +1,431 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	spoolSegmentSuffix = ".log"
+	spoolCursorFile    = "cursor"
+	// the reader polls the segment in case a notification is missed
+	spoolPollInterval = time.Second
+	// records pushed but not written yet, Push blocks only if the writer is that far behind
+	spoolHandoffSize = 1024
+)
+
+// spoolSegmentBytes is the size a segment is rotated at, it is a variable for tests
+var spoolSegmentBytes int64 = 4 * 1024 * 1024
+
+// spoolCursor is the position of the next record to deliver
+type spoolCursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// auditSpool is a write-ahead log of audit records of one sink. Records are appended
+// to segment files in dir as JSON lines and delivered in order, a record is delivered
+// again and again until the sink accepts it. The cursor is persisted after each delivery,
+// so records survive restarts and are delivered at least once. Records are written by
+// their own goroutine, so the disk I/O does not slow down the sessions pushing them.
+type auditSpool struct {
+	dir      string
+	sink     AuditSink
+	maxBytes int64
+	depth    int64 // records not delivered, accessed atomically
+	notify   chan struct{}
+	handoff  chan []byte // lines pushed and not written yet
+
+	sizeMu sync.Mutex
+	size   int64 // bytes of all segments and lines not written yet
+
+	mu        sync.Mutex
+	writer    *os.File
+	writeSeq  uint64
+	writeSize int64
+}
+
+func newAuditSpool(dir string, sink AuditSink, maxBytes int64) (*auditSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &auditSpool{dir: dir, sink: sink, maxBytes: maxBytes, notify: make(chan struct{}, 1), handoff: make(chan []byte, spoolHandoffSize)}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	cursor := s.loadCursor()
+	for _, seq := range segments {
+		// segments before the cursor are delivered
+		if seq < cursor.Segment {
+			_ = os.Remove(s.segmentPath(seq))
+			continue
+		}
+		info, err := os.Stat(s.segmentPath(seq))
+		if err != nil {
+			return nil, err
+		}
+		s.size += info.Size()
+		s.writeSeq = seq
+	}
+	switch {
+	case len(segments) == 0 || cursor.Segment > s.writeSeq:
+		// all segments are delivered
+		if cursor.Segment == 0 {
+			cursor.Segment = 1
+		}
+		cursor = spoolCursor{Segment: cursor.Segment}
+		s.writeSeq = cursor.Segment
+	case cursor.Segment < segments[0]:
+		cursor = spoolCursor{Segment: segments[0]}
+	}
+	if err = s.openWriter(); err != nil {
+		return nil, err
+	}
+	if s.depth, err = s.count(cursor); err != nil {
+		return nil, err
+	}
+	if s.depth > 0 {
+		klog.Infof("audit spool %v has %d records to replay", dir, s.depth)
+	}
+
+	go s.write()
+	go s.run(cursor)
+	return s, nil
+}
+
+func (s *auditSpool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentSuffix))
+}
+
+// segments returns sequences of segment files in ascending order
+func (s *auditSpool) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spoolSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// openWriter opens the last segment for append, a new segment is started if
+// the last one ends with a partial record written before crash
+func (s *auditSpool) openWriter() error {
+	path := s.segmentPath(s.writeSeq)
+	if data, err := ioutil.ReadFile(path); err == nil && len(data) > 0 && data[len(data)-1] != '\n' {
+		s.writeSeq++
+		path = s.segmentPath(s.writeSeq)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.writer, s.writeSize = f, info.Size()
+	return nil
+}
+
+// count returns records from cursor to the end
+func (s *auditSpool) count(cursor spoolCursor) (int64, error) {
+	segments, err := s.segments()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, seq := range segments {
+		if seq < cursor.Segment {
+			continue
+		}
+		data, err := ioutil.ReadFile(s.segmentPath(seq))
+		if err != nil {
+			return 0, err
+		}
+		if seq == cursor.Segment && cursor.Offset <= int64(len(data)) {
+			data = data[cursor.Offset:]
+		}
+		n += int64(bytes.Count(data, []byte("\n")))
+	}
+	return n, nil
+}
+
+func (s *auditSpool) loadCursor() spoolCursor {
+	cursor := spoolCursor{}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if err != nil {
+		return cursor
+	}
+	if err = json.Unmarshal(data, &cursor); err != nil {
+		klog.Errorf("invalid cursor of audit spool %v, replay from the first segment: %v", s.dir, err)
+		return spoolCursor{}
+	}
+	return cursor
+}
+
+// saveCursor replaces the cursor file atomically
+func (s *auditSpool) saveCursor(cursor spoolCursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, spoolCursorFile+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, spoolCursorFile))
+}
+
+// Push hands r over to the writer, it fails if the spool is full
+func (s *auditSpool) Push(r auditRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	// the space is taken before the line is written, so Push fails as soon as the spool is full
+	s.sizeMu.Lock()
+	if s.size+int64(len(line)) > s.maxBytes {
+		s.sizeMu.Unlock()
+		return fmt.Errorf("audit spool %s is full", s.dir)
+	}
+	s.size += int64(len(line))
+	s.sizeMu.Unlock()
+
+	atomic.AddInt64(&s.depth, 1)
+	s.handoff <- line
+	return nil
+}
+
+// write appends the lines handed over by Push to the last segment
+func (s *auditSpool) write() {
+	for line := range s.handoff {
+		n, err := s.append(line)
+		if err != nil && n == len(line) {
+			klog.Errorf("sync audit spool %s failed: %v", s.dir, err)
+		} else if err != nil {
+			s.release(int64(len(line) - n))
+			atomic.AddInt64(&s.depth, -1)
+			auditMessages.WithLabelValues(s.sink.Name(), auditResultDropped).Inc()
+			klog.Errorf("write audit spool %s failed, the message is dropped: %v", s.dir, err)
+			continue
+		}
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// append writes line to the last segment, a new segment is started once it is large enough
+func (s *auditSpool) append(line []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeSize >= spoolSegmentBytes {
+		_ = s.writer.Close()
+		s.writeSeq++
+		if err := s.openWriter(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.writer.Write(line)
+	s.writeSize += int64(n)
+	if err == nil && *auditSpoolSync {
+		err = s.writer.Sync()
+	}
+	return n, err
+}
+
+// release frees the space of bytes removed or not written
+func (s *auditSpool) release(n int64) {
+	s.sizeMu.Lock()
+	s.size -= n
+	s.sizeMu.Unlock()
+}
+
+func (s *auditSpool) Depth() int64 {
+	return atomic.LoadInt64(&s.depth)
+}
+
+// sealed returns true if no more records will be appended to the segment
+func (s *auditSpool) sealed(seq uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return seq < s.writeSeq
+}
+
+// run delivers records from cursor in order
+func (s *auditSpool) run(cursor spoolCursor) {
+	for {
+		next, err := s.deliverSegment(cursor)
+		if err != nil {
+			klog.Errorf("read audit spool %v failed: %v", s.segmentPath(cursor.Segment), err)
+			time.Sleep(spoolPollInterval)
+			continue
+		}
+		cursor = next
+	}
+}
+
+// deliverSegment delivers records of the segment of cursor, and returns the cursor
+// of the next segment once the segment is sealed and delivered
+func (s *auditSpool) deliverSegment(cursor spoolCursor) (spoolCursor, error) {
+	path := s.segmentPath(cursor.Segment)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && s.sealed(cursor.Segment) {
+		return spoolCursor{Segment: cursor.Segment + 1}, nil
+	}
+	if err != nil {
+		return cursor, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(cursor.Offset, io.SeekStart); err != nil {
+		return cursor, err
+	}
+
+	// records are delivered in batches of auditBatchSize, or whatever is available
+	var (
+		batch      []auditRecord
+		batchLines int64
+		batchBytes int64
+	)
+	flush := func() {
+		if batchLines == 0 {
+			return
+		}
+		s.deliver(batch)
+		cursor.Offset += batchBytes
+		atomic.AddInt64(&s.depth, -batchLines)
+		if err := s.saveCursor(cursor); err != nil {
+			klog.Errorf("save cursor of audit spool %v failed: %v", s.dir, err)
+		}
+		batch, batchLines, batchBytes = nil, 0, 0
+	}
+
+	// records may be appended between reaching the end and finding the segment sealed,
+	// so the segment is read to the end once more after it is sealed before removed
+	final := false
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			flush()
+			if !final && s.sealed(cursor.Segment) {
+				final = true
+				if _, err = f.Seek(cursor.Offset, io.SeekStart); err != nil {
+					return cursor, err
+				}
+				reader.Reset(f)
+				continue
+			}
+			if final {
+				// a partial record at the end of sealed segment is left by crash
+				s.removeSegment(path)
+				next := spoolCursor{Segment: cursor.Segment + 1}
+				if err = s.saveCursor(next); err != nil {
+					klog.Errorf("save cursor of audit spool %v failed: %v", s.dir, err)
+				}
+				return next, nil
+			}
+			// wait for more records, the partial record is read again
+			select {
+			case <-s.notify:
+			case <-time.After(spoolPollInterval):
+			}
+			if _, err = f.Seek(cursor.Offset, io.SeekStart); err != nil {
+				return cursor, err
+			}
+			reader.Reset(f)
+			continue
+		}
+		if err != nil {
+			flush()
+			return cursor, err
+		}
+
+		var r auditRecord
+		if err = json.Unmarshal(line, &r); err != nil {
+			klog.Errorf("skip invalid record in audit spool %v at %d: %v", path, cursor.Offset+batchBytes, err)
+		} else {
+			batch = append(batch, r)
+		}
+		batchLines++
+		batchBytes += int64(len(line))
+		if batchLines >= int64(*auditBatchSize) {
+			flush()
+		}
+	}
+}
+
+// deliver retries until the sink accepts all records
+func (s *auditSpool) deliver(batch []auditRecord) {
+	for i := 0; len(batch) > 0; i++ {
+		if i != 0 {
+			interval := auditRetryInterval(i)
+			klog.Warningf("[%v] send audit message to sink %v failed, retry after %v, backlog %d", batch[0].ID, s.sink.Name(), interval, s.Depth())
+			time.Sleep(interval)
+		}
+		n, err := publishRecords(s.sink, batch)
+		batch = batch[n:]
+		if err != nil {
+			klog.Errorf("publish audit message to sink %v failed: %v", s.sink.Name(), err)
+		}
+	}
+}
+
+func (s *auditSpool) removeSegment(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if err = os.Remove(path); err != nil {
+		klog.Errorf("remove delivered audit spool segment %v failed: %v", path, err)
+		return
+	}
+	s.release(info.Size())
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordSink keeps the ids of published records, it blocks while hold is not closed
+type recordSink struct {
+	hold chan struct{}
+
+	mu  sync.Mutex
+	ids []string
+}
+
+func newRecordSink(blocked bool) *recordSink {
+	sink := &recordSink{hold: make(chan struct{})}
+	if !blocked {
+		close(sink.hold)
+	}
+	return sink
+}
+
+func (r *recordSink) Name() string {
+	return "record"
+}
+
+func (r *recordSink) Publish(payload string, id string) error {
+	<-r.hold
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids = append(r.ids, id)
+	return nil
+}
+
+func (r *recordSink) published() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.ids...)
+}
+
+// waitPublished waits until the sink got n records and returns them
+func waitPublished(t *testing.T, sink *recordSink, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		ids := sink.published()
+		if len(ids) >= n {
+			return ids
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d records, want %d", len(ids), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitWritten waits until n records are written to the segments of the spool
+func waitWritten(t *testing.T, s *auditSpool, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		written, err := s.count(spoolCursor{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d records written, want %d", written, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func spoolIDs(from, to int) []string {
+	var ids []string
+	for i := from; i < to; i++ {
+		ids = append(ids, fmt.Sprintf("r%d", i))
+	}
+	return ids
+}
+
+func pushRecords(t *testing.T, s *auditSpool, ids []string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := s.Push(auditRecord{Payload: "payload of " + id, ID: id}); err != nil {
+			t.Fatalf("push %v: %v", id, err)
+		}
+	}
+}
+
+func assertIDs(t *testing.T, got, want []string) {
+	t.Helper()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("got records %v, want %v", got, want)
+	}
+}
+
+func TestAuditSpoolReplayAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// nothing is delivered before the restart
+	down, err := newAuditSpool(dir, newRecordSink(true), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushRecords(t, down, spoolIDs(0, 5))
+	waitWritten(t, down, 5)
+
+	sink := newRecordSink(false)
+	s, err := newAuditSpool(dir, sink, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Depth() != 5 {
+		t.Fatalf("got depth %d after restart, want 5", s.Depth())
+	}
+	assertIDs(t, waitPublished(t, sink, 5), spoolIDs(0, 5))
+
+	pushRecords(t, s, spoolIDs(5, 7))
+	assertIDs(t, waitPublished(t, sink, 7), spoolIDs(0, 7))
+
+	// the cursor is persisted, delivered records are not replayed
+	sink = newRecordSink(false)
+	s, err = newAuditSpool(dir, sink, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Depth() != 0 {
+		t.Fatalf("got depth %d after delivered, want 0", s.Depth())
+	}
+	pushRecords(t, s, spoolIDs(7, 8))
+	assertIDs(t, waitPublished(t, sink, 1), spoolIDs(7, 8))
+}
+
+func TestAuditSpoolPartialRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a crash leaves a partial record at the end of the last segment
+	data := `{"payload":"p","id":"r0"}` + "\n" + `{"payload":"p","id":`
+	s := &auditSpool{dir: dir}
+	if err = ioutil.WriteFile(s.segmentPath(1), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := newRecordSink(false)
+	s, err = newAuditSpool(dir, sink, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Depth() != 1 {
+		t.Fatalf("got depth %d, want 1", s.Depth())
+	}
+	pushRecords(t, s, spoolIDs(1, 3))
+	assertIDs(t, waitPublished(t, sink, 3), spoolIDs(0, 3))
+
+	// the partial segment is sealed and removed once delivered
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err = os.Stat(s.segmentPath(1)); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("segment with partial record is not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuditSpoolRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(size int64) { spoolSegmentBytes = size }(spoolSegmentBytes)
+	spoolSegmentBytes = 100
+
+	sink := newRecordSink(false)
+	s, err := newAuditSpool(dir, sink, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// records are pushed while segments are delivered and rotated
+	ids := spoolIDs(0, 200)
+	pushRecords(t, s, ids)
+	assertIDs(t, waitPublished(t, sink, len(ids)), ids)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		segments, err := s.segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) == 1 && s.Depth() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d segments and depth %d after delivered, want 1 and 0", len(segments), s.Depth())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuditSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newAuditSpool(dir, newRecordSink(true), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pushed int
+	for ; pushed < 100; pushed++ {
+		if err = s.Push(auditRecord{Payload: "payload", ID: fmt.Sprintf("r%d", pushed)}); err != nil {
+			break
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "is full") {
+		t.Fatalf("got error %v, want spool full", err)
+	}
+	if pushed == 0 || s.Depth() != int64(pushed) {
+		t.Fatalf("got depth %d with %d records pushed", s.Depth(), pushed)
+	}
+}
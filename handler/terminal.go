@@ -17,18 +17,20 @@ limitations under the License.
 package handler
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"k8s.io/klog/v2"
+	"net/http"
 	"time"
 
+	"github.com/emicklei/go-restful"
 	"github.com/kubecube-io/kubecube/pkg/clog"
-	"gopkg.in/igm/sockjs-go.v2/sockjs"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
+	"kubecube-webconsole/utils"
 	"strings"
 )
 
@@ -42,13 +44,17 @@ func (t TerminalSession) Next() *remotecommand.TerminalSize {
 // Read handles pty->process messages (stdin, resize)
 // Called in a loop from remotecommand as long as the process is running
 func (t TerminalSession) Read(p []byte) (int, error) {
-	m, err := t.sockJSSession.Recv()
+	if held := t.editor.Held(echoWaitTimeout); held != "" {
+		return copy(p, t.filterStdin(held)), nil
+	}
+
+	m, err := t.conn.Recv()
 	if err != nil {
 		return 0, err
 	}
 
 	if m == "ping" {
-		_ = t.sockJSSession.Send("pong")
+		_ = t.conn.Send("pong")
 		return 0, nil
 	}
 
@@ -59,35 +65,19 @@ func (t TerminalSession) Read(p []byte) (int, error) {
 
 	switch msg.Op {
 	case "stdin":
-		clog.Debug("[%v] stdin msg.Data content bytes: %v", t.id, []byte(msg.Data))
-		if !*enableAudit {
-			return copy(p, msg.Data), nil
+		if msg.Data, err = t.codec.DecodeInput(msg.Data); err != nil {
+			return 0, err
 		}
+		clog.Debug("[%v] stdin msg.Data content bytes: %v", t.id, []byte(msg.Data))
+		t.stats.addIn(len(msg.Data))
+		t.recorder.Input(msg.Data)
 
-		// Audit function
-		// user enters the enter key
-		if strings.HasSuffix(msg.Data, "\r") {
-			// if no command in buffer, no need to send
-			if t.stdinBuffer.String() != "" {
-				t.stdinBuffer.WriteString(strings.TrimSuffix(msg.Data, "\r"))
-				go func(cmd string) {
-					auditMsg := t.buildAuditMsg(cmd, "stdin")
-					payload, err := json.Marshal(auditMsg)
-					if err != nil {
-						klog.Errorf("marshal stdin audit message failed, %v", err)
-						return
-					}
-					AuditAdapter.Publish(string(payload), t.id)
-				}(t.stdinBuffer.String())
-			}
-
-			// clean buffer
-			t.stdinBuffer.Reset()
-		} else {
-			t.stdinBuffer.WriteString(msg.Data)
-		}
-		return copy(p, msg.Data), nil
+		return copy(p, t.filterStdin(msg.Data)), nil
 	case "resize":
+		t.recorder.Resize(msg.Cols, msg.Rows)
+		event := newSessionEvent(t.cInfo)
+		event.Rows, event.Cols = msg.Rows, msg.Cols
+		auditSessionEvent(t.id, t.cInfo, AuditSessionResized, fmt.Sprintf("resized to %dx%d", msg.Cols, msg.Rows), event)
 		t.sizeChan <- remotecommand.TerminalSize{Width: msg.Cols, Height: msg.Rows}
 		return 0, nil
 	default:
@@ -95,51 +85,125 @@ func (t TerminalSession) Read(p []byte) (int, error) {
 	}
 }
 
+// filterStdin audits the command lines submitted in data and returns what is sent to the container
+func (t TerminalSession) filterStdin(data string) string {
+	lines, n := t.editor.Input(data)
+	verdicts, forward := currentCommandPolicy().filterLines(t.cInfo.ClusterName, t.cInfo.Namespace, t.cInfo.Owner, data, lines, n)
+	for _, v := range verdicts {
+		if v.rule == nil {
+			// Audit function
+			t.auditLine(v.line, "stdin")
+			continue
+		}
+		switch v.rule.Action {
+		case CommandActionDeny:
+			clog.Info("[%v] command denied by rule %v: %v", t.id, v.rule.Name, v.line.Command)
+			t.auditLine(v.line, "deny")
+			_ = t.Toast(fmt.Sprintf("Command is denied: %s", v.rule.reason()))
+			t.editor.Reset()
+			continue
+		case CommandActionWarn:
+			_ = t.Toast(fmt.Sprintf("Warning: %s", v.rule.reason()))
+		}
+		t.auditLine(v.line, "stdin")
+	}
+	return forward
+}
+
 // Write handles process->pty stdout
 // Called from remotecommand whenever there is any output
 func (t TerminalSession) Write(p []byte) (int, error) {
-	if strings.Contains(string(p), "OCI runtime exec failed") && strings.Contains(string(p), "exec: \\\"/bin/bash\\\"") {
-		return 0, nil
+	if err := t.codec.SendOutput(p); err != nil {
+		return 0, err
 	}
+	t.stats.addOut(len(p))
+	t.editor.Output(p)
+	t.recorder.Output(p)
+	t.watchers.Broadcast(p)
+
+	// stdout auditing is optional
+	if *enableStdoutAudit {
+		if data := t.stdout.Write(string(p)); data != "" {
+			t.audit(data, "stdout")
+		}
+	}
+
+	return len(p), nil
+}
+
+// Toast sends an OOB message to be shown to the user
+func (t TerminalSession) Toast(data string) error {
+	return sendToast(t.conn, data)
+}
+
+func sendToast(conn TerminalConn, data string) error {
 	msg, err := json.Marshal(TerminalMessage{
-		Op:   "stdout",
-		Data: string(p),
+		Op:   "toast",
+		Data: data,
 	})
 	if err != nil {
-		return 0, err
-	}
-
-	if err = t.sockJSSession.Send(string(msg)); err != nil {
-		return 0, err
+		return err
 	}
+	return conn.Send(string(msg))
+}
 
-	// auditing is not enabled, or stdout auditing is not required, return directly
-	if !*enableAudit || !*enableStdoutAudit {
-		return len(p), nil
+// reportShell tells the client and the audit server which shell the session runs
+func (t TerminalSession) reportShell(shell string) {
+	clog.Info("session %v runs shell %v", t.id, shell)
+	event := newSessionEvent(t.cInfo)
+	event.Shell = shell
+	auditSessionEvent(t.id, t.cInfo, AuditShellSelected, shell, event)
+	msg, err := json.Marshal(TerminalMessage{
+		Op:   "shell",
+		Data: shell,
+	})
+	if err != nil {
+		return
 	}
-
-	go func(data string) {
-		auditMsg := t.buildAuditMsg(data, "stdout")
-		payload, err := json.Marshal(auditMsg)
-		if err != nil {
-			klog.Errorf("marshal stdout audit message failed, %v", err)
-			return
-		}
-		AuditAdapter.Publish(string(payload), t.id)
-	}(string(p))
-
-	return len(p), nil
+	_ = t.conn.Send(string(msg))
 }
 
 // Close shuts down the SockJS connection and sends the status code and reason to the client
 // Can happen if the process exits or if there is an error starting up the process
 // For now the status code is unused and reason is shown to the user (unless "")
+// Only the first close takes effect, it decides the status of the session_closed audit message.
 func (t TerminalSession) Close(status uint32, reason string) {
-	t.sockJSSession.Close(status, reason)
+	t.closer.close(status, reason, func() {
+		_ = t.conn.Close(status, reason)
+	})
+}
+
+// serveReadOnly reads from a connection which does not accept input until it is closed,
+// ping is answered and stdin is rejected with a toast
+func serveReadOnly(conn TerminalConn, notice string, onResize func(cols, rows uint16)) {
+	for {
+		m, err := conn.Recv()
+		if err != nil {
+			return
+		}
+		if m == "ping" {
+			_ = conn.Send("pong")
+			continue
+		}
+		var msg TerminalMessage
+		if err = json.Unmarshal([]byte(m), &msg); err != nil {
+			continue
+		}
+		switch msg.Op {
+		case "stdin":
+			toast, _ := json.Marshal(TerminalMessage{Op: "toast", Data: notice})
+			_ = conn.Send(string(toast))
+		case "resize":
+			if onResize != nil {
+				onResize(msg.Cols, msg.Rows)
+			}
+		}
+	}
 }
 
-// handleTerminalSession is Called by net/http for any new /api/sockjs connections
-func handleTerminalSession(session sockjs.Session) {
+// handleTerminalSession is Called by net/http for any new /api/sockjs or /api/websocket connections,
+// request is the websocket handshake which may carry the token if the bind message does not, nil for SockJS
+func handleTerminalSession(session TerminalConn, request *http.Request) {
 	var (
 		buf             string
 		err             error
@@ -162,60 +226,121 @@ func handleTerminalSession(session sockjs.Session) {
 		return
 	}
 
-	restClient, cfg, info, err := getConfigs(msg.SessionID)
+	if msg.Token == "" && request != nil {
+		msg.Token = utils.GetTokenFromReq(restful.NewRequest(request))
+	}
+	info, err := sessions.Consume(msg.SessionID, utils.GetUserFromToken(msg.Token))
 	if err != nil {
-		clog.Error("get rest client failed. Error msg: " + err.Error())
+		clog.Error("bind session %v failed: %v", msg.SessionID, err)
+		_ = session.Close(CloseStatusError, err.Error())
 		return
 	}
-
-	terminalSession = TerminalSession{
-		id:            msg.SessionID,
-		sockJSSession: session,
-		sizeChan:      make(chan remotecommand.TerminalSize),
-		stdinBuffer:   bytes.NewBufferString(""),
-		cInfo:         info,
+	if errInfo := sessionQuotas.Acquire(info); errInfo != nil {
+		clog.Warn("bind session %v rejected: %v", msg.SessionID, errInfo.Msg)
+		_ = session.Close(CloseStatusError, errInfo.Msg)
+		auditSessionClosed(msg.SessionID, info, nil, CloseStatusError, errInfo.Msg, nil)
+		return
 	}
+	defer sessionQuotas.Release(info)
+	restoreCredentials(info, msg.Token)
+	auditSessionEvent(msg.SessionID, info, AuditSessionBound, "session bound", newSessionEvent(info))
 
-	clog.Info("connect to container with cluster: %s, namespace: %s, pod name: %s, container name: %s, session id: %s", info.ClusterName, info.Namespace, info.PodName, info.ContainerName, msg.SessionID)
-	if err = connectToContainer(restClient, cfg, info, terminalSession); err != nil {
-		clog.Error("connect to container failed, session id: %v , error message: %v", msg.SessionID, err.Error())
-		terminalSession.Close(2, err.Error())
+	if info.WatchSession != "" {
+		handleWatchSession(newFrameCodec(session, msg.Encoding), msg.SessionID, info)
+		return
+	}
+	if info.Kind == SessionKindPortForward {
+		handlePortForwardSession(session, msg.SessionID, info)
 		return
 	}
-	terminalSession.Close(1, "process exited")
-}
 
-func getConfigs(sessionID string) (*rest.RESTClient, *rest.Config, *ConnInfo, error) {
-	var val string
-	var err error
-	var info *ConnInfo
+	restClient, cfg, err := getConfigs(info)
+	if err != nil {
+		clog.Error("get rest client failed. Error msg: " + err.Error())
+		_ = session.Close(CloseStatusError, err.Error())
+		auditSessionClosed(msg.SessionID, info, nil, CloseStatusError, err.Error(), err)
+		return
+	}
 
-	v, ok := connMap.Load(sessionID)
-	if ok {
-		val = v.(string)
+	terminalSession = TerminalSession{
+		id:       msg.SessionID,
+		conn:     session,
+		codec:    newFrameCodec(session, msg.Encoding),
+		sizeChan: make(chan remotecommand.TerminalSize),
+		editor:   newLineEditor(),
+		cInfo:    info,
+		recorder: newRecorder(msg.SessionID, info),
+		stats:    newSessionStats(),
+		watchers: newWatcherHub(*watchReplayBytes),
+		closer:   &sessionCloser{},
+		stdout:   newRedactStream(auditRedactors),
 	}
+	defer terminalSession.recorder.Close()
+	defer terminalSession.watchers.CloseAll("watched session ended")
+
+	liveSessions.Add(&terminalSession)
+	defer liveSessions.Remove(terminalSession.id)
+
+	done := make(chan struct{})
+	defer close(done)
+	go enforceTimeouts(terminalSession, terminalSession.id, info, terminalSession.stats, done)
 
-	err = json.Unmarshal([]byte(val), &info)
+	clog.Info("connect to container with cluster: %s, namespace: %s, pod name: %s, container name: %s, session id: %s", info.ClusterName, info.Namespace, info.PodName, info.ContainerName, msg.SessionID)
+	switch info.Kind {
+	case SessionKindLog:
+		err = streamContainerLog(restClient, info, terminalSession)
+	case SessionKindAttach:
+		err = attachToContainer(restClient, cfg, info, terminalSession)
+	case SessionKindDebug:
+		err = debugContainer(restClient, cfg, info, terminalSession)
+	case SessionKindNode:
+		err = nodeShell(restClient, cfg, info, terminalSession)
+	default:
+		err = connectToContainer(restClient, cfg, info, terminalSession)
+	}
+	if flushErr := terminalSession.codec.Flush(); flushErr != nil {
+		clog.Debug("flush output of session %v failed: %v", msg.SessionID, flushErr)
+	}
 	if err != nil {
-		clog.Error("unmarshal container-connect info from failed, key: %v, value: %v, error: %v", sessionID, val, err)
-		return nil, nil, nil, err
+		clog.Error("connect to container failed, session id: %v , error message: %v", msg.SessionID, err.Error())
+		terminalSession.Close(CloseStatusError, err.Error())
+	} else {
+		terminalSession.Close(CloseStatusExited, "process exited")
 	}
+	if *enableStdoutAudit {
+		if data := terminalSession.stdout.Flush(); data != "" {
+			terminalSession.audit(data, "stdout")
+		}
+	}
+	closer := terminalSession.closer
+	auditSessionClosed(terminalSession.id, info, terminalSession.stats, closer.status, closer.reason, err)
+}
 
-	v, err = getNonControlCfg(info.ClusterName)
-
+func getConfigs(info *ConnInfo) (*rest.RESTClient, *rest.Config, error) {
+	cfg, err := getNonControlCfg(info.ClusterName)
 	if err != nil {
 		clog.Error("failed to fetch rest.config for cluster [%s], msg: %v", info.ClusterName, err)
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
 
-	cfg, _ := (v).(*rest.Config)
-
 	restClient, err := rest.RESTClientFor(cfg)
 	if err != nil {
 		clog.Error("get rest client failed. Error msg: " + err.Error())
-		return nil, nil, nil, err
+		return nil, nil, err
+	}
+	return restClient, cfg, nil
+}
+
+// restoreCredentials gives the cloud shell the token of bind message if the session store does
+// not keep the credentials of the request, the shell downloads kubeconfig of the user with it
+func restoreCredentials(info *ConnInfo, token string) {
+	if !info.IsControlCluster || token == "" || info.Header.Get("Authorization") != "" {
+		return
+	}
+	if info.Header == nil {
+		info.Header = http.Header{}
 	}
-	return restClient, cfg, info, nil
+	info.Header.Set("Authorization", "Bearer "+token)
 }
 
 func connectToContainer(k8sClient *rest.RESTClient, cfg *rest.Config, info *ConnInfo, ptyHandler PtyHandler) error {
@@ -258,12 +383,35 @@ func connectToContainer(k8sClient *rest.RESTClient, cfg *rest.Config, info *Conn
 	}
 
 	cmds := buildCMD(info)
-	req = k8sClient.Post().
+	shell, err := discoverShell(k8sClient, cfg, info)
+	// the script runs if front end specifies the user in the container and the script is found by the shell,
+	// the session is never retried after it started
+	if cmds != nil {
+		if err != nil || scriptFound(k8sClient, cfg, info, shell) {
+			return execShell(k8sClient, cfg, info, cmds, *scriptName, ptyHandler)
+		}
+		clog.Info("script %v is not found in pod %v, fall back to %v", *scriptName, podName, shell)
+	}
+	// otherwise run the first shell found in the container
+	if err != nil {
+		clog.Error("discover shell of pod %v failed, %v", podName, err)
+		return err
+	}
+	return execShell(k8sClient, cfg, info, shell, strings.Join(shell, " "), ptyHandler)
+}
+
+// execShell runs cmds in the container with tty and reports shell to the session
+func execShell(k8sClient *rest.RESTClient, cfg *rest.Config, info *ConnInfo, cmds []string, shell string, ptyHandler PtyHandler) error {
+	if t, ok := ptyHandler.(TerminalSession); ok {
+		t.reportShell(shell)
+	}
+
+	req := k8sClient.Post().
 		Resource("pods").
-		Name(podName).
-		Namespace(namespace).
+		Name(info.PodName).
+		Namespace(info.Namespace).
 		SubResource("exec").
-		Param(ResourceContainer, containerName).
+		Param(ResourceContainer, info.ContainerName).
 		Param(IoStdin, "true").
 		Param(IoStdout, "true").
 		Param(IoStderr, "true").
@@ -272,34 +420,69 @@ func connectToContainer(k8sClient *rest.RESTClient, cfg *rest.Config, info *Conn
 		Command: cmds,
 	}, scheme.ParameterCodec)
 
-	// try to run `/bin/bash` after into container
+	clog.Info("try to connect to container with cmds: %v", cmds)
 	err := postReq(req, cfg, ptyHandler)
-	// if err, run `/bin/sh`
 	if err != nil {
-		cmds := []string{"/bin/sh"}
-		req = k8sClient.Post().
-			Resource("pods").
-			Name(podName).
-			Namespace(namespace).
-			SubResource("exec").
-			Param(ResourceContainer, containerName).
-			Param(IoStdin, "true").
-			Param(IoStdout, "true").
-			Param(IoStderr, "true").
-			Param(TTY, "true")
-		req = req.VersionedParams(&v1.PodExecOptions{
-			Command: cmds,
-		}, scheme.ParameterCodec)
-		clog.Info("try to connect to container with cmds: %v", cmds)
-		shErr := postReq(req, cfg, ptyHandler)
-		if shErr != nil {
-			clog.Error("connect to pod %v failed, %v", podName, err)
-			return shErr
-		}
+		clog.Error("connect to pod %v failed, %v", info.PodName, err)
+		return err
 	}
 	return nil
 }
 
+// attachToContainer attaches to the main process of container as `kubectl attach -it` does,
+// the container must be started with stdin and tty
+func attachToContainer(k8sClient *rest.RESTClient, cfg *rest.Config, info *ConnInfo, ptyHandler PtyHandler) error {
+	req := k8sClient.Post().
+		Resource("pods").
+		Name(info.PodName).
+		Namespace(info.Namespace).
+		SubResource("attach")
+	req = req.VersionedParams(&v1.PodAttachOptions{
+		Container: info.ContainerName,
+		Stdin:     true,
+		Stdout:    true,
+		TTY:       true,
+	}, scheme.ParameterCodec)
+
+	if t, ok := ptyHandler.(TerminalSession); ok {
+		_ = t.Toast("If you don't see a command prompt, try pressing enter.")
+	}
+
+	clog.Info("try to attach to container %v of pod %v", info.ContainerName, info.PodName)
+	err := postReq(req, cfg, ptyHandler)
+	if err != nil {
+		clog.Error("attach to pod %v failed, %v", info.PodName, err)
+	}
+	return err
+}
+
+// execStream runs cmds in the container without tty and blocks until it exits
+func execStream(k8sClient *rest.RESTClient, cfg *rest.Config, info *ConnInfo, cmds []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	req := k8sClient.Post().
+		Resource("pods").
+		Name(info.PodName).
+		Namespace(info.Namespace).
+		SubResource("exec")
+	req = req.VersionedParams(&v1.PodExecOptions{
+		Command:   cmds,
+		Container: info.ContainerName,
+		Stdin:     stdin != nil,
+		Stdout:    stdout != nil,
+		Stderr:    stderr != nil,
+	}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(cfg, "POST", req.URL())
+	if err != nil {
+		clog.Error("new SPDY executor failed, %v", err)
+		return err
+	}
+	return exec.Stream(remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
+
 func postReq(req *rest.Request, cfg *rest.Config, ptyHandler PtyHandler) error {
 	exec, err := remotecommand.NewSPDYExecutor(cfg, "POST", req.URL())
 	if err != nil {
@@ -334,28 +517,59 @@ func buildCMD(info *ConnInfo) []string {
 		cmds = append(cmds, "-a", info.ScriptUserAuth)
 	}
 
-	// if front end does not specify the user in the container, run `/bin/bash` directly in the container
+	// the shell is discovered if front end does not specify the user in the container
 	if !userFlag {
-		cmds = []string{"/bin/bash"}
+		return nil
 	}
 
-	clog.Info("try to connect to container with cmds: %v", cmds)
-
 	return cmds
 }
 
+// audit sends data to audit server asynchronously if audit is enabled
+func (t TerminalSession) audit(data string, dataType string) {
+	publishAudit(t.buildAuditMsg(data, dataType))
+}
+
+// auditLine sends the command of line, with its raw keystrokes if auditKeystrokes is set
+func (t TerminalSession) auditLine(line editedLine, dataType string) {
+	msg := t.buildAuditMsg(line.Command, dataType)
+	if *auditKeystrokes {
+		msg.Keystrokes = line.Keystrokes
+	}
+	publishAudit(msg)
+}
+
 func (t TerminalSession) buildAuditMsg(cmd string, dataType string) *AuditMsg {
+	return newAuditMsg(t.id, t.cInfo, cmd, dataType)
+}
+
+// publishAudit queues msg to the audit sinks if audit is enabled, it only blocks
+// when the queue is full and auditOverloadPolicy is block
+func publishAudit(msg *AuditMsg) {
+	if !*enableAudit {
+		return
+	}
+	redactAudit(msg)
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		klog.Errorf("marshal %v audit message failed, %v", msg.DataType, err)
+		return
+	}
+	auditSinks.Publish(string(payload), msg.SessionID)
+}
+
+func newAuditMsg(id string, info *ConnInfo, data string, dataType string) *AuditMsg {
 	msg := &AuditMsg{
-		SessionID:     t.id,
-		Data:          cmd,
+		SessionID:     id,
+		Data:          data,
 		DataType:      dataType,
 		CreateTime:    time.Now(),
-		PodName:       t.cInfo.PodName,
-		Namespace:     t.cInfo.Namespace,
-		ClusterName:   t.cInfo.ClusterName,
-		ContainerUser: t.cInfo.ScriptUser,
+		PodName:       info.PodName,
+		Namespace:     info.Namespace,
+		ClusterName:   info.ClusterName,
+		ContainerUser: info.ScriptUser,
 	}
-	auditRawInfo := t.cInfo.AuditRawInfo
+	auditRawInfo := info.AuditRawInfo
 	if auditRawInfo != nil {
 		msg.RemoteIP = auditRawInfo.RemoteIP
 		msg.UserAgent = auditRawInfo.UserAgent
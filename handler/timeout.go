@@ -0,0 +1,94 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/kubecube-io/kubecube/pkg/clog"
+)
+
+// timeoutCheckInterval is how often a session checks its idle timeout and max duration, it is a variable for tests
+var timeoutCheckInterval = time.Second
+
+// sessionTimeouts returns the idle timeout and max duration of sessions in the cluster and namespace, 0 disables them
+func sessionTimeouts(cluster, namespace string) (idle time.Duration, max time.Duration) {
+	return sessionIdleTimeoutList.Get(cluster, namespace, *sessionIdleTimeout),
+		sessionMaxDurationList.Get(cluster, namespace, *sessionMaxDuration)
+}
+
+// timedSession is a session closed by enforceTimeouts, such as terminal sessions and port forwards
+type timedSession interface {
+	Toast(data string) error
+	Close(status uint32, reason string)
+}
+
+// enforceTimeouts closes the session once it has no input or output for the idle timeout
+// or it lasts for the max duration, the user is warned by toast sessionTimeoutWarning before.
+// It returns when done is closed.
+func enforceTimeouts(t timedSession, id string, info *ConnInfo, stats *sessionStats, done <-chan struct{}) {
+	idle, max := sessionTimeouts(info.ClusterName, info.Namespace)
+	if idle <= 0 && max <= 0 {
+		return
+	}
+	ticker := time.NewTicker(timeoutCheckInterval)
+	defer ticker.Stop()
+
+	idleWarned, maxWarned := false, false
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if max > 0 {
+				left := stats.startTime.Add(max).Sub(now)
+				if left <= 0 {
+					closeByTimeout(t, id, CloseStatusMaxDuration, fmt.Sprintf("session reached the max duration %v", max))
+					return
+				}
+				if left <= *sessionTimeoutWarning && !maxWarned {
+					maxWarned = true
+					_ = t.Toast(fmt.Sprintf("Session will be closed in %v as it reaches the max duration %v", left.Round(time.Second), max))
+				}
+			}
+			if idle > 0 {
+				lastActivity := time.Unix(0, atomic.LoadInt64(&stats.lastActivity))
+				left := lastActivity.Add(idle).Sub(now)
+				if left <= 0 {
+					closeByTimeout(t, id, CloseStatusIdleTimeout, fmt.Sprintf("session idle for %v", idle))
+					return
+				}
+				switch {
+				case left > *sessionTimeoutWarning:
+					// warn again if it becomes idle after activity
+					idleWarned = false
+				case !idleWarned:
+					idleWarned = true
+					_ = t.Toast(fmt.Sprintf("Session will be closed in %v if it stays idle", left.Round(time.Second)))
+				}
+			}
+		}
+	}
+}
+
+func closeByTimeout(t timedSession, id string, status uint32, reason string) {
+	clog.Info("close session %v: %v", id, reason)
+	_ = t.Toast(reason)
+	t.Close(status, reason)
+}
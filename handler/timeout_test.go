@@ -0,0 +1,113 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordSession is a timedSession which records the toasts and the close status
+type recordSession struct {
+	mu     sync.Mutex
+	toasts []string
+	status uint32
+	closed chan struct{}
+}
+
+func (s *recordSession) Toast(data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.toasts = append(s.toasts, data)
+	return nil
+}
+
+func (s *recordSession) Close(status uint32, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	close(s.closed)
+}
+
+// setTimeouts sets the timeout flags and a short check interval until the test ends
+func setTimeouts(t *testing.T, idle, max, warning time.Duration) {
+	flags := []*time.Duration{sessionIdleTimeout, sessionMaxDuration, sessionTimeoutWarning, &timeoutCheckInterval}
+	for i, value := range []time.Duration{idle, max, warning, 5 * time.Millisecond} {
+		f, old := flags[i], *flags[i]
+		*f = value
+		t.Cleanup(func() { *f = old })
+	}
+}
+
+func TestEnforceTimeouts(t *testing.T) {
+	tests := []struct {
+		name       string
+		idle, max  time.Duration
+		wantStatus uint32
+	}{
+		{"idle timeout", 50 * time.Millisecond, 0, CloseStatusIdleTimeout},
+		{"max duration", time.Hour, 50 * time.Millisecond, CloseStatusMaxDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTimeouts(t, tt.idle, tt.max, 30*time.Millisecond)
+			s := &recordSession{closed: make(chan struct{})}
+			done := make(chan struct{})
+			defer close(done)
+			go enforceTimeouts(s, "id", &ConnInfo{ClusterName: "a"}, newSessionStats(), done)
+
+			select {
+			case <-s.closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("session is not closed")
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", s.status, tt.wantStatus)
+			}
+			// the warning and the reason
+			if len(s.toasts) != 2 {
+				t.Fatalf("got toasts %q", s.toasts)
+			}
+		})
+	}
+}
+
+func TestEnforceTimeoutsActivity(t *testing.T) {
+	setTimeouts(t, 50*time.Millisecond, 0, 0)
+	s := &recordSession{closed: make(chan struct{})}
+	stats := newSessionStats()
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		enforceTimeouts(s, "id", &ConnInfo{ClusterName: "a"}, stats, done)
+		close(exited)
+	}()
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stats.addIn(1)
+	}
+	close(done)
+	<-exited
+	select {
+	case <-s.closed:
+		t.Fatal("active session is closed")
+	default:
+	}
+}
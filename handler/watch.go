@@ -0,0 +1,238 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/emicklei/go-restful"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+	"kubecube-webconsole/errdef"
+	"kubecube-webconsole/utils"
+)
+
+// watcherQueueBytes is how much output is queued for a watcher,
+// a watcher falling further behind is disconnected so it never blocks the watched session
+const watcherQueueBytes = 1024 * 1024
+
+// watcherHub fans out the output of a terminal session to read-only watchers,
+// and keeps the recent output to replay for late joiners
+type watcherHub struct {
+	mu       sync.Mutex
+	watchers map[string]*watcher
+	recent   []byte
+	limit    int
+}
+
+// watcher sends the queued output to one watcher connection in its own goroutine
+type watcher struct {
+	codec *frameCodec
+	conn  drainConn
+	wake  chan struct{}
+
+	mu      sync.Mutex
+	pending []byte
+	stopped bool
+	// status and reason close conn once the queued output is sent if reason is set
+	status uint32
+	reason string
+}
+
+func newWatcher(codec *frameCodec, conn drainConn) *watcher {
+	return &watcher{codec: codec, conn: conn, wake: make(chan struct{}, 1)}
+}
+
+// queue appends p to the pending output, it returns false if the queue is full
+func (w *watcher) queue(p []byte) bool {
+	w.mu.Lock()
+	if len(w.pending)+len(p) > watcherQueueBytes {
+		w.mu.Unlock()
+		return false
+	}
+	w.pending = append(w.pending, p...)
+	w.mu.Unlock()
+	w.notify()
+	return true
+}
+
+// stop ends the sender after the pending output is sent
+func (w *watcher) stop(status uint32, reason string) {
+	w.mu.Lock()
+	w.stopped = true
+	w.status, w.reason = status, reason
+	w.mu.Unlock()
+	w.notify()
+}
+
+func (w *watcher) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) send() {
+	for range w.wake {
+		w.mu.Lock()
+		p, stopped := w.pending, w.stopped
+		w.pending = nil
+		w.mu.Unlock()
+
+		if len(p) > 0 {
+			if err := w.codec.SendOutput(p); err != nil {
+				clog.Debug("send to watcher failed: %v", err)
+			}
+		}
+		if stopped {
+			_ = w.codec.Flush()
+			if w.reason != "" {
+				w.conn.Close(w.status, w.reason)
+			}
+			return
+		}
+	}
+}
+
+func newWatcherHub(limit int) *watcherHub {
+	return &watcherHub{
+		watchers: make(map[string]*watcher),
+		limit:    limit,
+	}
+}
+
+// Broadcast queues the output to all watchers and appends it to the recent output
+func (h *watcherHub) Broadcast(p []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.limit > 0 {
+		h.recent = append(h.recent, p...)
+		if over := len(h.recent) - h.limit; over > 0 {
+			h.recent = append(h.recent[:0], h.recent[over:]...)
+		}
+	}
+	for id, w := range h.watchers {
+		if !w.queue(p) {
+			clog.Warn("watcher %v falls behind, disconnect it", id)
+			delete(h.watchers, id)
+			w.stop(0, "")
+			// the sender may be blocked by the connection, which is closed to release it
+			go w.conn.Close(CloseStatusError, "watcher can not keep up with the session output")
+		}
+	}
+}
+
+// Add registers a watcher and replays the recent output to it, conn is closed through its closer
+func (h *watcherHub) Add(id string, codec *frameCodec, conn drainConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := newWatcher(codec, conn)
+	recent := h.recent
+	if over := len(recent) - watcherQueueBytes; over > 0 {
+		recent = recent[over:]
+	}
+	w.queue(recent)
+	h.watchers[id] = w
+	go w.send()
+}
+
+func (h *watcherHub) Remove(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if w, ok := h.watchers[id]; ok {
+		delete(h.watchers, id)
+		w.stop(0, "")
+	}
+}
+
+func (h *watcherHub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.watchers)
+}
+
+// CloseAll closes all watchers after their queued output when the watched session ends
+func (h *watcherHub) CloseAll(reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, w := range h.watchers {
+		delete(h.watchers, id)
+		w.stop(CloseStatusExited, reason)
+	}
+}
+
+// handleWatchShell issues a session id to watch a running session of the pod
+func handleWatchShell(request *restful.Request, response *restful.Response) {
+	target, ok := liveSessions.Get(request.PathParameter("session"))
+	if !ok || target.cInfo.ClusterName != request.PathParameter(ClusterKey) ||
+		target.cInfo.Namespace != request.PathParameter(NamespaceKey) ||
+		target.cInfo.PodName != request.PathParameter("pod") {
+		errdef.HandleInternalErrorByCode(response, errdef.SessionNotFound)
+		return
+	}
+
+	cInfo, errInfo := getConnInfo(request)
+	if errInfo != nil {
+		errdef.HandleInternalErrorByCode(response, *errInfo)
+		return
+	}
+	cInfo.ContainerName = target.cInfo.ContainerName
+	cInfo.Owner = utils.GetUserFromReq(request)
+	cInfo.WatchSession = target.id
+
+	sessionId, err := issueSession(cInfo)
+	if err != nil {
+		clog.Error("generate session id failed. Error msg: " + err.Error())
+		errdef.HandleInternalError(response, err)
+		return
+	}
+	clog.Info("user %v requests to watch session %v, sessionId: %s", cInfo.Owner, target.id, sessionId)
+
+	_ = response.WriteHeaderAndEntity(http.StatusOK, TerminalResponse{Id: sessionId})
+}
+
+// handleWatchSession serves a read-only watcher until it disconnects or the watched session ends,
+// it has no timeouts of its own as the watched session is closed by them
+func handleWatchSession(codec *frameCodec, id string, info *ConnInfo) {
+	session := codec.conn
+	target, ok := liveSessions.Get(info.WatchSession)
+	if !ok {
+		_ = session.Close(CloseStatusError, errdef.SessionNotFound.Msg)
+		auditSessionClosed(id, info, nil, CloseStatusError, errdef.SessionNotFound.Msg, nil)
+		return
+	}
+
+	stats := newSessionStats()
+	conn := drainConns.Add(id, session, true)
+	target.watchers.Add(id, codec, conn)
+	clog.Info("user %v starts watching session %v", info.Owner, target.id)
+	target.audit(fmt.Sprintf("%s starts watching", info.Owner), "watch")
+
+	defer func() {
+		drainConns.Remove(id)
+		target.watchers.Remove(id)
+		clog.Info("user %v stops watching session %v", info.Owner, target.id)
+		target.audit(fmt.Sprintf("%s stops watching", info.Owner), "watch")
+		conn.Close(CloseStatusExited, "watcher disconnected")
+		auditSessionClosed(id, info, stats, conn.closer.status, conn.closer.reason, nil)
+	}()
+
+	serveReadOnly(session, "read-only session, input is ignored", nil)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// watchConn records the sent messages, Send blocks until the connection is closed if stalled
+type watchConn struct {
+	recordConn
+	mu      sync.Mutex
+	stalled bool
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func newWatchConn(stalled bool) *watchConn {
+	return &watchConn{stalled: stalled, closed: make(chan struct{})}
+}
+
+func (c *watchConn) Send(s string) error {
+	if c.stalled {
+		<-c.closed
+		return errors.New("closed")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recordConn.Send(s)
+}
+
+func (c *watchConn) Close(status uint32, reason string) error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *watchConn) waitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher is not closed")
+	}
+}
+
+func TestWatcherHubSlowWatcher(t *testing.T) {
+	h := newWatcherHub(1024)
+	slow := newWatchConn(true)
+	slowConn := newConnRegistry().Add("slow", slow, true)
+	h.Add("slow", newFrameCodec(slow, EncodingText), slowConn)
+
+	done := make(chan struct{})
+	go func() {
+		chunk := []byte(strings.Repeat("x", 32*1024))
+		for i := 0; i <= watcherQueueBytes/len(chunk)+1; i++ {
+			h.Broadcast(chunk)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast is blocked by the slow watcher")
+	}
+
+	slow.waitClosed(t)
+	if slowConn.closer.status != CloseStatusError || h.Len() != 0 {
+		t.Fatalf("got status %d and %d watchers", slowConn.closer.status, h.Len())
+	}
+}
+
+func TestWatcherHubCloseAll(t *testing.T) {
+	h := newWatcherHub(1024)
+	h.Broadcast([]byte("$ "))
+	conn := newWatchConn(false)
+	watcherConn := newConnRegistry().Add("watcher", conn, true)
+	h.Add("watcher", newFrameCodec(conn, EncodingText), watcherConn)
+	for i := 0; i < 100; i++ {
+		h.Broadcast([]byte("x"))
+	}
+	h.Broadcast([]byte("\xe4"))
+
+	h.CloseAll("watched session ended")
+	conn.waitClosed(t)
+	// the watcher disconnects after it is closed
+	watcherConn.Close(CloseStatusExited, "watcher disconnected")
+	if watcherConn.closer.status != CloseStatusExited || watcherConn.closer.reason != "watched session ended" {
+		t.Fatalf("got status %d, reason %q", watcherConn.closer.status, watcherConn.closer.reason)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	got := strings.Join(conn.outputs(t), "")
+	if want := "$ " + strings.Repeat("x", 100) + "\ufffd"; got != want {
+		t.Fatalf("got output %q, want %q", got, want)
+	}
+}
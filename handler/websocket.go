@@ -0,0 +1,120 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kubecube-io/kubecube/pkg/clog"
+)
+
+const (
+	// application close codes are 4000-4999 in RFC 6455, TerminalSession status is added to it
+	wsCloseCodeBase  = 4000
+	wsCloseWriteWait = time.Second
+	// a stalled client fails the write after wsWriteWait instead of blocking the writer forever
+	wsWriteWait = 10 * time.Second
+	// the reason of close frame must not be longer than 123 bytes
+	wsMaxCloseReason = 123
+	// wsMaxMessageBytes is the largest frame read, such as a terminal message with a paste
+	// or a frame of port forward, larger ones close the connection instead of being buffered
+	wsMaxMessageBytes = 1024 * 1024
+)
+
+// webSocketConn implements TerminalConn with a plain RFC 6455 WebSocket,
+// each TerminalMessage is sent in one text frame as SockJS does
+type webSocketConn struct {
+	conn *websocket.Conn
+	// gorilla websocket supports one concurrent writer only
+	writeMu sync.Mutex
+}
+
+func (c *webSocketConn) Recv() (string, error) {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (c *webSocketConn) Send(msg string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+func (c *webSocketConn) SendBinary(p []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteMessage(websocket.BinaryMessage, p)
+}
+
+func (c *webSocketConn) Close(status uint32, reason string) error {
+	c.writeMu.Lock()
+	msg := websocket.FormatCloseMessage(wsCloseCodeBase+int(status), truncateCloseReason(reason))
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsCloseWriteWait))
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+// truncateCloseReason cuts reason to wsMaxCloseReason bytes without splitting a utf-8 sequence,
+// browsers fail the connection if the reason of close frame is not valid utf-8
+func truncateCloseReason(reason string) string {
+	if len(reason) <= wsMaxCloseReason {
+		return reason
+	}
+	p := []byte(reason[:wsMaxCloseReason])
+	return string(p[:utf8Boundary(p)])
+}
+
+// CreateWebSocketHandler is called from main for /api/websocket
+func CreateWebSocketHandler() http.Handler {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: checkWebSocketOrigin(*webSocketOrigins),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			clog.Warn("upgrade to websocket failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetReadLimit(wsMaxMessageBytes)
+		handleTerminalSession(&webSocketConn{conn: conn}, r)
+	})
+}
+
+// checkWebSocketOrigin returns nil to use the same origin check of gorilla websocket if no origin configured
+func checkWebSocketOrigin(origins string) func(r *http.Request) bool {
+	if origins == "" {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(origins, ",") {
+		allowed[strings.TrimSpace(origin)] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || allowed["*"] || allowed[origin]
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2021 KubeCube Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTruncateCloseReason(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   string
+	}{
+		{"process exited", "process exited"},
+		{strings.Repeat("a", 123), strings.Repeat("a", 123)},
+		{strings.Repeat("a", 130), strings.Repeat("a", 123)},
+		// 你 is 3 bytes, the 41st one would end at byte 123
+		{strings.Repeat("你", 50), strings.Repeat("你", 41)},
+		{"a" + strings.Repeat("你", 50), "a" + strings.Repeat("你", 40)},
+		{"ab" + strings.Repeat("你", 50), "ab" + strings.Repeat("你", 40)},
+	}
+	for _, tt := range tests {
+		got := truncateCloseReason(tt.reason)
+		if got != tt.want {
+			t.Errorf("truncate %d bytes: got %q, want %q", len(tt.reason), got, tt.want)
+		}
+		if len(got) > wsMaxCloseReason || !utf8.ValidString(got) {
+			t.Errorf("got invalid reason %q", got)
+		}
+	}
+}
+
+func TestWebSocketReadLimit(t *testing.T) {
+	server := httptest.NewServer(CreateWebSocketHandler())
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err = conn.WriteMessage(websocket.TextMessage, make([]byte, wsMaxMessageBytes+1)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("got error %v, want close message too big", err)
+	}
+}
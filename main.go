@@ -23,10 +23,13 @@ import (
 	consolelog "kubecube-webconsole/clog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/kubecube-io/kubecube/pkg/clients"
 	"github.com/kubecube-io/kubecube/pkg/clog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
@@ -39,10 +42,15 @@ import (
 // leader flag
 var leader = false
 
+// serverShutdownTimeout limits waiting for http requests in flight on shutdown,
+// websocket connections are closed by handler.Drain
+const serverShutdownTimeout = 5 * time.Second
+
 func init() {
 	flag.Parse()
 	clients.InitCubeClientSetWithOpts(nil)
 	clog.InitCubeLoggerWithOpts(consolelog.NewLogConfig())
+	handler.Init()
 }
 
 func main() {
@@ -58,27 +66,34 @@ func main() {
 		return
 	}
 
-	runAPIServer()
+	server := runAPIServer()
 
-	rl, err := resourcelock.New(resourcelock.ConfigMapsResourceLock,
-		handler.LeaderElectionNamespace,
+	// the lock only elects the replica running singleton tasks, in active-active mode
+	// every replica serves sessions, otherwise only the leader is ready. Both the ConfigMap
+	// and the Lease are held, so replicas of older versions electing by the ConfigMap
+	// do not become leader at the same time during a rolling upgrade.
+	rl, err := resourcelock.New(resourcelock.ConfigMapsLeasesResourceLock,
+		*handler.LeaseNamespace,
 		handler.LeaderElectionKey,
-		client.CoreV1(), nil,
+		client.CoreV1(), client.CoordinationV1(),
 		resourcelock.ResourceLockConfig{
 			Identity: hostname,
 		})
 	if err != nil {
-		clog.Error("error creating lock: %v", err)
+		clog.Fatal("error creating lock: %v", err)
 	}
 
 	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
-		Lock:          rl,
-		LeaseDuration: 15 * time.Second,
-		RenewDeadline: 10 * time.Second,
-		RetryPeriod:   2 * time.Second,
+		Lock:            rl,
+		ReleaseOnCancel: true,
+		LeaseDuration:   *handler.LeaseDuration,
+		RenewDeadline:   *handler.LeaseRenewDeadline,
+		RetryPeriod:     *handler.LeaseRetryPeriod,
 		Callbacks: leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(ctx context.Context) {
 				leader = true
+				clog.Info("leader election won")
+				handler.RunLeaderTasks(ctx)
 			},
 			OnStoppedLeading: func() {
 				leader = false
@@ -87,32 +102,60 @@ func main() {
 		},
 	})
 	if err != nil {
-		clog.Error("leader election fail, be member")
+		clog.Fatal("leader election fail: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	electionDone := make(chan struct{})
+	go func() {
+		defer close(electionDone)
+		// Run returns once the lease is lost, campaign again until shutdown
+		for ctx.Err() == nil {
+			le.Run(ctx)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	clog.Info("received signal %v, shutting down", sig)
+
+	handler.Drain()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancelShutdown()
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		clog.Warn("shutdown http server failed: %v", err)
 	}
-	le.Run(context.Background())
+	// release the lease so another replica takes over singleton tasks at once
+	cancel()
+	<-electionDone
+	clog.Info("shutdown completed")
 }
 
-func runAPIServer() {
+func runAPIServer() *http.Server {
 	// provide api for livenessProbe
 	http.HandleFunc("/healthz", func(response http.ResponseWriter, request *http.Request) {
 		clog.Debug("Health check")
 		response.WriteHeader(http.StatusOK)
 	})
+	http.Handle("/metrics", promhttp.Handler())
 	http.Handle("/api/", handler.CreateHTTPAPIHandler())
 	http.Handle("/api/sockjs/", handler.CreateAttachHandler("/api/sockjs"))
-	// provide api for readinessProbe，avoid service flow into in-leader pod
+	http.Handle("/api/websocket", handler.CreateWebSocketHandler())
+	// provide api for readinessProbe，avoid service flow into in-leader pod unless in active-active mode
 	http.HandleFunc("/leader", func(response http.ResponseWriter, request *http.Request) {
 		statusCode := http.StatusOK
-		if !leader {
+		if (!leader && !*handler.ActiveActive) || handler.IsDraining() {
 			statusCode = http.StatusBadRequest
 		}
 		response.WriteHeader(statusCode)
 	})
 
+	server := &http.Server{Addr: fmt.Sprintf(":%d", *handler.ServerPort)}
 	go func() {
-		err := http.ListenAndServe(fmt.Sprintf(":%d", *handler.ServerPort), nil)
-		if err != nil {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			clog.Fatal("ListenAndServe failed，error msg: %s", err.Error())
 		}
 	}()
+	return server
 }
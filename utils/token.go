@@ -57,7 +57,10 @@ func GetTokenFromReq(request *restful.Request) string {
 }
 
 func GetUserFromReq(request *restful.Request) string {
-	token := GetTokenFromReq(request)
+	return GetUserFromToken(GetTokenFromReq(request))
+}
+
+func GetUserFromToken(token string) string {
 	if token != "" {
 		claims := ParseToken(token)
 		if claims != nil {